@@ -3,6 +3,8 @@ module github.com/destinygg/twitch-subscriber-sync
 go 1.16
 
 require (
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gomodule/redigo v1.8.9
 	github.com/gorilla/websocket v1.4.2
 	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/naoina/go-stringutil v0.1.0 // indirect
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// a twitchscrape section can list several channels:
+//
+//	[[twitchscrape.channels]]
+//	channel = "partner"
+//	channelid = "12345"
+//
+// every unset key of a channel block is taken from the twitchscrape section,
+// except for the ones below, the files get the name of the channel appended
+// so that the channels do not share them
+//
+// a key is unset if it has the zero value, so a block can not set maxexpire,
+// maxexpirepercent or totaltolerance back to 0 while the section sets them,
+// totaltolerance = -1 still turns the check off
+var notInherited = map[string]bool{
+	"Channel":      true,
+	"ChannelID":    true,
+	"AccessToken":  true,
+	"RefreshToken": true,
+	"TokensFile":   true,
+	"SnapshotFile": true,
+	"AdminAddr":    true,
+	"Channels":     true,
+}
+
+func (ts *TwitchScrape) inheritChannels() {
+	base := reflect.ValueOf(ts).Elem()
+	for i := range ts.Channels {
+		ch := &ts.Channels[i]
+		v := reflect.ValueOf(ch).Elem()
+		for j := 0; j < v.NumField(); j++ {
+			if notInherited[v.Type().Field(j).Name] {
+				continue
+			}
+			if f := v.Field(j); f.IsZero() {
+				f.Set(base.Field(j))
+			}
+		}
+
+		if ch.TokensFile == "" {
+			ch.TokensFile = ChannelPath(ts.TokensFile, ch.Channel)
+		}
+		if ch.SnapshotFile == "" && ts.SnapshotFile != "" {
+			ch.SnapshotFile = ChannelPath(ts.SnapshotFile, ch.Channel)
+		}
+	}
+}
+
+// ChannelPath inserts the name of the channel before the extension of path
+func ChannelPath(path, channel string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + channel + ext
+}
+
+// PubSubTopics returns the topics twitchpubsub listens to for ts
+func (ts *TwitchScrape) PubSubTopics() []string {
+	if len(ts.Topics) == 0 {
+		return []string{"subscriptions"}
+	}
+	return ts.Topics
+}
+
+// TopicURL returns the key and the value of the endpoint the events of a
+// pubsub topic are sent to, ok is false for unknown topics
+func (ts *TwitchScrape) TopicURL(topic string) (key, url string, ok bool) {
+	switch topic {
+	case "subscriptions":
+		return "suburl", ts.SubURL, true
+	case "bits":
+		return "bitsurl", ts.BitsURL, true
+	case "points":
+		return "pointsurl", ts.PointsURL, true
+	}
+	return "", "", false
+}
+
+// ChannelNames returns the names of the channel blocks in the order of the
+// config file
+func (c *AppConfig) ChannelNames() []string {
+	names := make([]string, 0, len(c.TwitchScrape.Channels))
+	for _, ch := range c.TwitchScrape.Channels {
+		names = append(names, ch.Channel)
+	}
+	return names
+}
+
+// Channel returns the config seen by a single channel, its twitchscrape
+// section is replaced by the channel block, nil if there is no such block
+func (c *AppConfig) Channel(name string) *AppConfig {
+	for _, ch := range c.TwitchScrape.Channels {
+		if ch.Channel == name {
+			cc := *c
+			cc.TwitchScrape = ch
+			return &cc
+		}
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"os"
 	"github.com/naoina/toml"
@@ -32,6 +33,14 @@ type Website struct {
 	BaseHost      string `toml:"basehost"`
 	CDNHost       string `toml:"cdnhost"`
 	PrivateAPIKey string `toml:"privateapikey"`
+	// AuthMode is how the private key is sent: "query" (the default) as the
+	// privatekey parameter, "header" in the Authorization header or "hmac"
+	// as a signature of the request, see internal/dggapi
+	AuthMode string `toml:"authmode"`
+	// DeadLetterDir keeps the payloads the website did not accept, defaults
+	// to "deadletter"
+	DeadLetterDir string `toml:"deadletterdir"`
+	TLS           TLS    `toml:"tls"`
 }
 
 type Debug struct {
@@ -70,6 +79,57 @@ type TwitchScrape struct {
 	Password     string `toml:"password"`
 	Channel      string `toml:"channel"`
 	ChannelID    string `toml:"channelid"`
+	// SnapshotStore is "file" (the default), "database" or "redis"
+	SnapshotStore string `toml:"snapshotstore"`
+	SnapshotFile  string `toml:"snapshotfile"`
+	// expiring more subs than the lower of these in a single sync is held back
+	// until released, 0 disables the limit
+	MaxExpire        int     `toml:"maxexpire"`
+	MaxExpirePercent float64 `toml:"maxexpirepercent"`
+	AdminAddr        string  `toml:"adminaddr"`
+	AdminPassword    string  `toml:"adminpassword"`
+	// TotalTolerance is how much the number of collected subs may differ from
+	// the total twitch reports, 0 means the default of 5, negative disables it
+	TotalTolerance int `toml:"totaltolerance"`
+	// AuthURL overrides https://id.twitch.tv/oauth2/
+	AuthURL string `toml:"authurl"`
+	// TokensFile defaults to the -tokens flag
+	TokensFile string `toml:"tokensfile"`
+	// Topics are what twitchpubsub listens to with the pubsub transport, any
+	// of "subscriptions" (the default), "bits" and "points", the events are
+	// sent to SubURL, BitsURL and PointsURL respectively
+	Topics    []string `toml:"topics"`
+	BitsURL   string   `toml:"bitsurl"`
+	PointsURL string   `toml:"pointsurl"`
+	// GiftURL and SubEndURL receive the eventsub gift batches and ended subs,
+	// the website treats everything sent to SubURL as a new sub, so these
+	// events are not subscribed to unless their url is set
+	GiftURL   string `toml:"gifturl"`
+	SubEndURL string `toml:"subendurl"`
+	// TLS is used for every twitch endpoint
+	TLS TLS `toml:"tls"`
+	// Channels lets a single process sync several channels, see channels.go
+	Channels []TwitchScrape `toml:"channels"`
+}
+
+type TwitchPubSub struct {
+	// Transport is "eventsub" (the default), "webhook" or the legacy "pubsub"
+	Transport          string `toml:"transport"`
+	EventSubURL        string `toml:"eventsuburl"`
+	HelixURL           string `toml:"helixurl"`
+	KeepaliveSeconds   int    `toml:"keepaliveseconds"`
+	WebhookAddr        string `toml:"webhookaddr"`
+	WebhookSecret      string `toml:"webhooksecret"`
+	WebhookCallbackURL string `toml:"webhookcallbackurl"`
+	// MaxTopics is how many topics a single pubsub connection listens to,
+	// twitch allows 50, which is the default
+	MaxTopics int `toml:"maxtopics"`
+	// QueueDir keeps the events until the website accepted them, defaults to
+	// "queue"
+	QueueDir string `toml:"queuedir"`
+	// MaxAttempts is how often an event is tried before it is dead lettered,
+	// defaults to 20
+	MaxAttempts int `toml:"maxattempts"`
 }
 
 type AppConfig struct {
@@ -79,6 +139,7 @@ type AppConfig struct {
 	Redis        `toml:"redis"`
 	Metrics      `toml:"metrics"`
 	TwitchScrape `toml:"twitchscrape"`
+	TwitchPubSub `toml:"twitchpubsub"`
 }
 
 type TwitchTokens struct {
@@ -93,54 +154,102 @@ func Init(ctx context.Context) context.Context {
 	settingsFile = flag.String("config", "settings.cfg", `path to the config file`)
 	tokensFile = flag.String("tokens", "twitchtokens", `path to the tokens file`)
 	flag.Parse()
-	cfg := ReadSettingsFile()
-	ReadTokensFile(&cfg.TwitchScrape, false)
-	return context.WithValue(ctx, "appconfig", cfg)
+	cfg, err := ReadSettingsFile()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	h := &Holder{}
+	h.Set(cfg)
+	return context.WithValue(ctx, "appconfig", h)
 }
 
-func ReadSettingsFile() *AppConfig {
+// ReadTokens reads the tokens files into the config in ctx, it is separate
+// from Init so that the config can be validated without touching any files
+func ReadTokens(ctx context.Context) error {
+	h := HolderFromContext(ctx)
+	cfg := *h.Get()
+	cfg.TwitchScrape.Channels = append([]TwitchScrape(nil), cfg.TwitchScrape.Channels...)
+	if len(cfg.TwitchScrape.Channels) == 0 {
+		if err := ReadTokensFile(&cfg.TwitchScrape, false); err != nil {
+			return err
+		}
+	}
+	for i := range cfg.TwitchScrape.Channels {
+		if err := ReadTokensFile(&cfg.TwitchScrape.Channels[i], false); err != nil {
+			return err
+		}
+	}
+	h.Set(&cfg)
+	return nil
+}
+
+func ReadSettingsFile() (*AppConfig, error) {
 	f, err := os.OpenFile(*settingsFile, os.O_RDONLY, 0660)
-	defer f.Close()
 	if err != nil {
-		panic("Could not open " + *settingsFile + " err: " + err.Error())
+		return nil, fmt.Errorf("could not open the config file: %v", err)
 	}
+	defer f.Close()
+
 	cfg := &AppConfig{}
 	if err := ReadConfig(f, cfg); err != nil {
-		panic("Failed to parse config file, err: " + err.Error())
+		return nil, fmt.Errorf("could not parse %s: %v", *settingsFile, err)
+	}
+	if err := ApplyEnv(cfg); err != nil {
+		return nil, fmt.Errorf("could not apply the environment: %v", err)
 	}
-	return cfg
+	if cfg.TwitchScrape.TokensFile == "" && tokensFile != nil {
+		cfg.TwitchScrape.TokensFile = *tokensFile
+	}
+	cfg.TwitchScrape.inheritChannels()
+	return cfg, nil
 }
 
-func ReadTokensFile(cfg *TwitchScrape, overwrite bool) {
-	f, err := os.OpenFile(*tokensFile, os.O_CREATE|os.O_RDWR, 0660)
-	defer f.Close()
+// ReadTokensFile reads the tokens file into cfg, if the file is empty or
+// overwrite is set the tokens in cfg are written to it first
+func ReadTokensFile(cfg *TwitchScrape, overwrite bool) error {
+	path := cfg.TokensFile
+	unlock, err := LockTokensFile(path)
 	if err != nil {
-		panic("Could not open " + *tokensFile + " err: " + err.Error())
+		return fmt.Errorf("could not lock %s: %v", path, err)
 	}
-	if info, err := f.Stat(); err == nil && (info.Size() == 0 || overwrite) {
-		var tokenStr string
-		tokenStr = "accesstoken=\""+ cfg.AccessToken +"\"\r\n"
-		tokenStr += "refreshtoken=\""+ cfg.RefreshToken +"\"\r\n"
-		if info.Size() > 0 {
-			f.Truncate(0)
-			f.Seek(0, 0)
+	defer unlock()
+
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not open %s: %v", path, err)
+	}
+	tokens := &TwitchTokens{AccessToken: cfg.AccessToken, RefreshToken: cfg.RefreshToken}
+	if err != nil || info.Size() == 0 || overwrite {
+		if err := SaveTokens(path, tokens); err != nil {
+			return fmt.Errorf("could not write %s: %v", path, err)
 		}
-		io.WriteString(f, tokenStr)
-		f.Seek(0, 0)
 	}
-	tokens := &TwitchTokens{}
-	if err := ReadConfig(f, tokens); err != nil {
-		panic("Failed to parse config file, err: " + err.Error())
+	if err := LoadTokens(path, tokens); err != nil {
+		return fmt.Errorf("could not parse %s: %v", path, err)
 	}
 	cfg.AccessToken = tokens.AccessToken
 	cfg.RefreshToken = tokens.RefreshToken
+	return nil
 }
 
 func ReadConfig(r io.Reader, d interface{}) error {
 	return toml.NewDecoder(r).Decode(d)
 }
 
+// FromContext returns the current config, it is replaced on a reload so
+// long running code should keep the Holder instead
 func FromContext(ctx context.Context) *AppConfig {
-	cfg, _ := ctx.Value("appconfig").(*AppConfig)
-	return cfg
+	return HolderFromContext(ctx).Get()
+}
+
+func HolderFromContext(ctx context.Context) *Holder {
+	h, _ := ctx.Value("appconfig").(*Holder)
+	return h
+}
+
+// WithHolder returns a context using h as the config, used to set up the
+// components of a single channel
+func WithHolder(ctx context.Context, h *Holder) context.Context {
+	return context.WithValue(ctx, "appconfig", h)
 }
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is prepended to every environment variable read by ApplyEnv
+const EnvPrefix = "TSS_"
+
+// ApplyEnv overrides the fields of cfg from the environment, so that secrets
+// do not have to be stored in the config file
+//
+// every field can be set with TSS_<SECTION>_<KEY>, where section and key are
+// the uppercased names used in the config file, for example
+// TSS_TWITCHSCRAPE_CLIENTSECRET, or with TSS_<SECTION>_<KEY>_FILE pointing at
+// a file holding the value, trailing newlines are removed from it
+//
+// the channel blocks are addressed by their uppercased channel name, for
+// example TSS_TWITCHSCRAPE_CHANNELS_PARTNER_CLIENTSECRET, a key set this way
+// is not inherited from the twitchscrape section
+//
+// the precedence from lowest to highest is: the config file, the _FILE
+// variable, the plain variable
+func ApplyEnv(cfg *AppConfig) error {
+	return applyEnv(reflect.ValueOf(cfg).Elem(), EnvPrefix)
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("toml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < fv.Len(); j++ {
+				block := blockName(fv.Index(j))
+				if block == "" {
+					continue
+				}
+				if err := applyEnv(fv.Index(j), name+"_"+strings.ToUpper(block)+"_"); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		value, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(fv, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// blockName returns the name a block of a list is addressed by in the
+// environment, empty if it has none
+func blockName(v reflect.Value) string {
+	f := v.FieldByName("Channel")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
+
+// lookupEnv returns the value of name, or the contents of the file name_FILE
+// points at if name is not set
+func lookupEnv(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("could not read %s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// setValue sets the scalar fields, others can only be set from the file
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("%s fields can not be set from the environment", v.Kind())
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package config
+
+import "os"
+
+// locking is not supported on windows, the tokens file must not be shared
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// Holder holds the current config so that it can be swapped on a reload, it
+// is safe for concurrent use, the held config must not be modified
+type Holder struct {
+	v    atomic.Value
+	name string
+
+	mu       sync.Mutex
+	channels map[string]*Holder
+}
+
+func (h *Holder) Get() *AppConfig {
+	cfg, _ := h.v.Load().(*AppConfig)
+	return cfg
+}
+
+// Set swaps in cfg and updates the holders of the channels along with it
+func (h *Holder) Set(cfg *AppConfig) {
+	h.v.Store(cfg)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, ch := range h.channels {
+		if c := cfg.Channel(name); c != nil {
+			ch.Set(c)
+		}
+	}
+}
+
+// Name returns the name of the channel, empty if h is not a channel holder
+func (h *Holder) Name() string {
+	return h.name
+}
+
+// Channel returns the holder of the named channel block, it follows the
+// reloads of h, nil if there is no such block
+func (h *Holder) Channel(name string) *Holder {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.channels[name]; ok {
+		return ch
+	}
+	cfg := h.Get().Channel(name)
+	if cfg == nil {
+		return nil
+	}
+	ch := &Holder{name: name}
+	ch.v.Store(cfg)
+	if h.channels == nil {
+		h.channels = map[string]*Holder{}
+	}
+	h.channels[name] = ch
+	return ch
+}
+
+// Reload reads the config file again and swaps it in if it is valid for app,
+// the old config stays in place otherwise
+// the tokens in the reloaded config are ignored, twitchauth owns them after
+// startup
+func Reload(ctx context.Context, app string) (*AppConfig, error) {
+	h := HolderFromContext(ctx)
+	cfg, err := ReadSettingsFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(app); err != nil {
+		return nil, err
+	}
+	// every channel runs its own components, those are only set up on startup
+	old, cur := strings.Join(h.Get().ChannelNames(), ", "), strings.Join(cfg.ChannelNames(), ", ")
+	if old != cur {
+		return nil, fmt.Errorf("the channels changed from [%s] to [%s], that needs a restart", old, cur)
+	}
+	h.Set(cfg)
+	return cfg, nil
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS configures the connections to the website or to twitch:
+//
+//	[website.tls]
+//	certfile = "client.pem"
+//	keyfile = "client.key"
+//	cafile = "ca.pem"
+//	minversion = "1.2"
+//
+// the client certificate is only sent when the server asks for it, the
+// certificates in cafile are trusted in addition to the system ones
+type TLS struct {
+	CertFile string `toml:"certfile"`
+	KeyFile  string `toml:"keyfile"`
+	CAFile   string `toml:"cafile"`
+	// MinVersion is one of "1.0", "1.1", "1.2" (the default) or "1.3"
+	MinVersion string `toml:"minversion"`
+}
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config loads the files and returns the config for the http clients, the
+// files are only read here, changing them needs a restart
+func (t *TLS) Config() (*tls.Config, error) {
+	version, ok := tlsVersions[t.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown minversion %q", t.MinVersion)
+	}
+	c := &tls.Config{MinVersion: version}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("certfile and keyfile have to be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the ca bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientCert writes a self signed client certificate and its key to dir
+func clientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "twitchscrape"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return cert, certFile, keyFile
+}
+
+func get(t *testing.T, cfg TLS, url string) error {
+	c, err := cfg.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {}
+
+func TestTLSCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(ok))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+
+	if err := get(t, TLS{CAFile: caFile}, srv.URL); err != nil {
+		t.Fatalf("with cafile: %v", err)
+	}
+	if err := get(t, TLS{}, srv.URL); err == nil {
+		t.Fatal("the test server was trusted without cafile")
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir := t.TempDir()
+	cert, certFile, keyFile := clientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(ok))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+
+	if err := get(t, TLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, srv.URL); err != nil {
+		t.Fatalf("with the client certificate: %v", err)
+	}
+	if err := get(t, TLS{CAFile: caFile}, srv.URL); err == nil {
+		t.Fatal("the server accepted a client without a certificate")
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, _ := clientCert(t, dir)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no pem here"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  TLS
+	}{
+		{"unknown minversion", TLS{MinVersion: "1.4"}},
+		{"certfile without keyfile", TLS{CertFile: certFile}},
+		{"missing keyfile", TLS{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")}},
+		{"missing cafile", TLS{CAFile: filepath.Join(dir, "missing.pem")}},
+		{"cafile without certificates", TLS{CAFile: empty}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.Config(); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/atomicfile"
+)
+
+// LockTokensFile takes an exclusive lock shared by every process using the
+// same tokens file, twitch refresh tokens are single use so only one of them
+// may refresh at a time, call the returned func to release the lock
+func LockTokensFile(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// LoadTokens reads the tokens file at path into t, empty tokens leave t alone
+// the caller must hold the lock
+func LoadTokens(path string, t *TwitchTokens) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tokens := &TwitchTokens{}
+	if err := ReadConfig(f, tokens); err != nil {
+		return err
+	}
+	if tokens.AccessToken != "" || tokens.RefreshToken != "" {
+		*t = *tokens
+	}
+	return nil
+}
+
+// SaveTokens replaces the tokens file at path with t, the previous tokens are
+// kept in a .bak file next to it
+// the caller must hold the lock
+func SaveTokens(path string, t *TwitchTokens) error {
+	tokenStr := "accesstoken=\"" + t.AccessToken + "\"\r\n"
+	tokenStr += "refreshtoken=\"" + t.RefreshToken + "\"\r\n"
+
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(old) > 0 && string(old) != tokenStr {
+		if err := atomicfile.Write(path+".bak", old, 0660); err != nil {
+			return err
+		}
+	}
+	return atomicfile.Write(path, []byte(tokenStr), 0660)
+}
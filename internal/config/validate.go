@@ -0,0 +1,238 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// channel names end up in file and table names, twitch logins fit this anyway
+var channelName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// the binaries sharing the config, Validate checks what the given one needs
+const (
+	AppTwitchScrape = "twitchscrape"
+	AppTwitchPubSub = "twitchpubsub"
+)
+
+// FieldError is a problem with a single setting, Field is section.key as in
+// the config file
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+// ValidationError lists every problem found by Validate
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return "invalid config:\n  " + strings.Join(msgs, "\n  ")
+}
+
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) required(field, value string) {
+	if value == "" {
+		v.fail(field, "is required")
+	}
+}
+
+// url checks that value is an absolute url, empty values are allowed
+func (v *validator) url(field, value string, schemes ...string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		v.fail(field, "%q is not an absolute url", value)
+		return
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return
+		}
+	}
+	v.fail(field, "%q must use one of the schemes %s", value, strings.Join(schemes, ", "))
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(field, "%q must be one of %q", value, allowed)
+}
+
+// tls checks that the files of t can be loaded, prefix is the section of t
+func (v *validator) tls(prefix string, t *TLS) {
+	if _, err := t.Config(); err != nil {
+		v.fail(strings.TrimSuffix(prefix, "."), "%v", err)
+	}
+}
+
+// Validate checks the settings app needs, every problem is returned in a
+// ValidationError
+func (c *AppConfig) Validate(app string) error {
+	v := &validator{}
+
+	v.required("debug.logfile", c.Debug.Logfile)
+	v.required("website.privateapikey", c.Website.PrivateAPIKey)
+	v.oneOf("website.authmode", c.Website.AuthMode, "", "query", "header", "hmac")
+	v.tls("website.tls.", &c.Website.TLS)
+
+	switch app {
+	case AppTwitchScrape:
+		c.validateTwitchScrape(v)
+	case AppTwitchPubSub:
+		c.validateTwitchPubSub(v)
+	default:
+		v.fail("app", "unknown app %q", app)
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// validateTwitch checks the settings shared by both apps, prefix is the
+// section of ts
+func (c *AppConfig) validateTwitch(v *validator, prefix string, ts *TwitchScrape) {
+	v.required(prefix+"clientid", ts.ClientID)
+	v.required(prefix+"channelid", ts.ChannelID)
+	v.url(prefix+"authurl", ts.AuthURL, "http", "https")
+	v.tls(prefix+"tls.", &ts.TLS)
+}
+
+func (c *AppConfig) validateTwitchScrape(v *validator) {
+	if len(c.TwitchScrape.Channels) == 0 {
+		c.validateChannel(v, "twitchscrape.", &c.TwitchScrape)
+		return
+	}
+
+	// the channel blocks already inherited the unset settings
+	seen := map[string]bool{}
+	files := map[string]bool{}
+	addrs := map[string]bool{}
+	for i := range c.TwitchScrape.Channels {
+		ch := &c.TwitchScrape.Channels[i]
+		prefix := fmt.Sprintf("twitchscrape.channels[%d].", i)
+		v.required(prefix+"channel", ch.Channel)
+		if ch.Channel != "" && !channelName.MatchString(ch.Channel) {
+			v.fail(prefix+"channel", "%q may only contain letters, digits and underscores", ch.Channel)
+		}
+		if ch.Channel != "" && seen[ch.Channel] {
+			v.fail(prefix+"channel", "%q is listed more than once", ch.Channel)
+		}
+		seen[ch.Channel] = true
+		if files[ch.TokensFile] {
+			v.fail(prefix+"tokensfile", "%q is used by another channel", ch.TokensFile)
+		}
+		files[ch.TokensFile] = true
+		if ch.AdminAddr != "" && addrs[ch.AdminAddr] {
+			v.fail(prefix+"adminaddr", "%q is used by another channel", ch.AdminAddr)
+		}
+		addrs[ch.AdminAddr] = true
+		c.validateChannel(v, prefix, ch)
+	}
+}
+
+func (c *AppConfig) validateChannel(v *validator, prefix string, ts *TwitchScrape) {
+	c.validateTwitch(v, prefix, ts)
+	if ts.PollMinutes <= 0 {
+		v.fail(prefix+"pollminutes", "must be greater than 0, got %d", ts.PollMinutes)
+	}
+	v.required(prefix+"getsuburl", ts.GetSubURL)
+	v.url(prefix+"getsuburl", ts.GetSubURL, "http", "https")
+	v.required(prefix+"modsuburl", ts.ModSubURL)
+	v.url(prefix+"modsuburl", ts.ModSubURL, "http", "https")
+
+	v.oneOf(prefix+"snapshotstore", ts.SnapshotStore, "", "file", "database", "redis")
+	switch ts.SnapshotStore {
+	case "database":
+		v.required("database.dsn", c.Database.DSN)
+	case "redis":
+		v.required("redis.addr", c.Redis.Addr)
+	}
+
+	if ts.MaxExpire < 0 {
+		v.fail(prefix+"maxexpire", "must not be negative, got %d", ts.MaxExpire)
+	}
+	if ts.MaxExpirePercent < 0 || ts.MaxExpirePercent > 100 {
+		v.fail(prefix+"maxexpirepercent", "must be between 0 and 100, got %v", ts.MaxExpirePercent)
+	}
+	if ts.AdminAddr != "" && ts.AdminPassword == "" {
+		v.fail(prefix+"adminpassword", "is required when adminaddr is set")
+	}
+}
+
+func (c *AppConfig) validateTwitchPubSub(v *validator) {
+	ps := &c.TwitchPubSub
+	if len(c.TwitchScrape.Channels) == 0 {
+		c.validateTopics(v, "twitchscrape.", &c.TwitchScrape)
+	} else if ps.Transport != "pubsub" {
+		v.fail("twitchpubsub.transport", "must be \"pubsub\" to listen to the channel blocks, eventsub and webhook only subscribe to [twitchscrape], got %q", ps.Transport)
+	}
+	// eventsub and webhook only subscribe to subs, anything else would be
+	// silently dropped
+	if ps.Transport != "pubsub" {
+		for _, topic := range c.TwitchScrape.PubSubTopics() {
+			if topic != "subscriptions" {
+				v.fail("twitchscrape.topics", "%q needs the \"pubsub\" transport, got %q", topic, ps.Transport)
+			}
+		}
+	}
+	for i := range c.TwitchScrape.Channels {
+		c.validateTopics(v, fmt.Sprintf("twitchscrape.channels[%d].", i), &c.TwitchScrape.Channels[i])
+	}
+	if ps.MaxTopics < 0 || ps.MaxTopics > 50 {
+		v.fail("twitchpubsub.maxtopics", "must be between 1 and 50, got %d", ps.MaxTopics)
+	}
+
+	v.oneOf("twitchpubsub.transport", ps.Transport, "", "eventsub", "webhook", "pubsub")
+	v.url("twitchpubsub.eventsuburl", ps.EventSubURL, "ws", "wss")
+	v.url("twitchpubsub.helixurl", ps.HelixURL, "http", "https")
+	v.url("twitchscrape.gifturl", c.TwitchScrape.GiftURL, "http", "https")
+	v.url("twitchscrape.subendurl", c.TwitchScrape.SubEndURL, "http", "https")
+	if s := ps.KeepaliveSeconds; s != 0 && (s < 10 || s > 600) {
+		v.fail("twitchpubsub.keepaliveseconds", "must be between 10 and 600, got %d", s)
+	}
+
+	if ps.Transport == "webhook" {
+		v.required("twitchpubsub.webhookaddr", ps.WebhookAddr)
+		// twitch only accepts secrets of this length
+		if l := len(ps.WebhookSecret); l < 10 || l > 100 {
+			v.fail("twitchpubsub.webhooksecret", "must be between 10 and 100 characters long, got %d", l)
+		}
+		v.url("twitchpubsub.webhookcallbackurl", ps.WebhookCallbackURL, "https")
+	}
+}
+
+func (c *AppConfig) validateTopics(v *validator, prefix string, ts *TwitchScrape) {
+	c.validateTwitch(v, prefix, ts)
+	for _, topic := range ts.PubSubTopics() {
+		key, value, ok := ts.TopicURL(topic)
+		if !ok {
+			v.fail(prefix+"topics", "unknown topic %q", topic)
+			continue
+		}
+		v.required(prefix+key, value)
+		v.url(prefix+key, value, "http", "https")
+	}
+}
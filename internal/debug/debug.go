@@ -62,6 +62,13 @@ func Init(ctx context.Context) context.Context {
 	return ctx
 }
 
+// SetDebugging turns the printing of debugging information on or off
+func SetDebugging(on bool) {
+	mu.Lock()
+	debuggingEnabled = on
+	mu.Unlock()
+}
+
 func shouldPrint() bool {
 	mu.RLock()
 	defer mu.RUnlock()
@@ -0,0 +1,60 @@
+package dggapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/ids"
+)
+
+// the headers of the hmac auth mode
+const (
+	HeaderTimestamp = "X-Dgg-Timestamp"
+	HeaderNonce     = "X-Dgg-Nonce"
+	HeaderSignature = "X-Dgg-Signature"
+)
+
+// authorize adds the private key to req the way Website.AuthMode says
+//
+//	query   ?privatekey=<key>, the legacy mode
+//	header  Authorization: Bearer <key>
+//	hmac    the key never leaves the process, the request carries
+//	        X-Dgg-Timestamp (unix seconds), X-Dgg-Nonce (random hex) and
+//	        X-Dgg-Signature, the hex hmac-sha256 with the key of
+//	        timestamp \n nonce \n method \n uri \n body
+//
+// uri is the path with the query string as sent, the website should reject stale timestamps and reused nonces
+func authorize(req *http.Request, body []byte, cfg *config.Website) error {
+	switch cfg.AuthMode {
+	case "header":
+		req.Header.Set("Authorization", "Bearer "+cfg.PrivateAPIKey)
+	case "hmac":
+		nonce, err := ids.Nonce()
+		if err != nil {
+			return err
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, ts)
+		req.Header.Set(HeaderNonce, nonce)
+		req.Header.Set(HeaderSignature, Sign(cfg.PrivateAPIKey, ts, nonce, req.Method, req.URL.RequestURI(), body))
+	default:
+		q := req.URL.Query()
+		q.Set("privatekey", cfg.PrivateAPIKey)
+		req.URL.RawQuery = q.Encode()
+	}
+	return nil
+}
+
+// Sign returns the signature of the hmac auth mode, uri is the path and the
+// query string of the request
+func Sign(key, timestamp, nonce, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + method + "\n" + uri + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,75 @@
+package dggapi
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+)
+
+const testURI = "/api/twitch/subs?sub=1"
+
+var testBody = []byte(`{"42":1}`)
+
+func TestSign(t *testing.T) {
+	got := Sign("secret", "1700000000", "abcdef", "POST", testURI, testBody)
+	want := "ce3c48f59f773fc77775d59ff0ec7cf2db0a405d88fd21091d0064190fba1685"
+	if got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+	if Sign("secret", "1700000000", "abcdef", "POST", "/api/twitch/subs", testBody) == want {
+		t.Fatal("the query string is not part of the signature")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		mode      string
+		query     string
+		auth      string
+		signature bool
+	}{
+		{"", "sub=1&privatekey=secret", "", false},
+		{"query", "sub=1&privatekey=secret", "", false},
+		{"header", "sub=1", "Bearer secret", false},
+		{"hmac", "sub=1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://website"+testURI, nil)
+			cfg := &config.Website{PrivateAPIKey: "secret", AuthMode: tt.mode}
+			if err := authorize(req, testBody, cfg); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := url.ParseQuery(tt.query)
+			if req.URL.Query().Encode() != want.Encode() {
+				t.Fatalf("query = %q, want %q", req.URL.RawQuery, tt.query)
+			}
+			if got := req.Header.Get("Authorization"); got != tt.auth {
+				t.Fatalf("authorization = %q, want %q", got, tt.auth)
+			}
+
+			ts, nonce := req.Header.Get(HeaderTimestamp), req.Header.Get(HeaderNonce)
+			sig := req.Header.Get(HeaderSignature)
+			if !tt.signature {
+				if ts != "" || nonce != "" || sig != "" {
+					t.Fatalf("hmac headers set: %q %q %q", ts, nonce, sig)
+				}
+				return
+			}
+			sec, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil || time.Since(time.Unix(sec, 0)) > time.Minute {
+				t.Fatalf("timestamp = %q", ts)
+			}
+			if nonce == "" {
+				t.Fatal("no nonce")
+			}
+			if want := Sign("secret", ts, nonce, "POST", testURI, testBody); sig != want {
+				t.Fatalf("signature = %s, want %s", sig, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Package dggapi is the client of the website api shared by twitchscrape and
+// twitchpubsub
+package dggapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+)
+
+const (
+	// how many times idempotent calls are tried
+	maxTries = 3
+	// the wait before the first retry, doubled for every further one
+	retryWait = 500 * time.Millisecond
+)
+
+// StatusError is returned when the website responds with a non-2xx status
+type StatusError struct {
+	Method     string
+	Endpoint   string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: non-2xx statuscode received from the website %d", e.Method, e.Endpoint, e.StatusCode)
+}
+
+// Response implements dlq.ResponseError
+func (e *StatusError) Response() (int, string) {
+	return e.StatusCode, e.Body
+}
+
+// Error is a call that got no response
+type Error struct {
+	Method   string
+	Endpoint string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Method, e.Endpoint, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type Client struct {
+	cfg    *config.Holder
+	client *http.Client
+}
+
+// New creates the client, the tls settings are read once here
+func New(cfg *config.Holder) *Client {
+	tlsConfig, err := cfg.Get().Website.TLS.Config()
+	if err != nil {
+		d.F("invalid website.tls: %v", err)
+	}
+	return &Client{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:       tlsConfig,
+				ResponseHeaderTimeout: 5 * time.Second,
+			},
+		},
+	}
+}
+
+func (c *Client) Get(endpoint string) ([]byte, error) {
+	return c.Do("GET", endpoint, nil)
+}
+
+func (c *Client) Post(endpoint string, body []byte) ([]byte, error) {
+	return c.Do("POST", endpoint, body)
+}
+
+// Do calls the endpoint and returns the body of a 2xx response, idempotent
+// calls are retried on network errors and 5xx responses
+func (c *Client) Do(method, endpoint string, body []byte) ([]byte, error) {
+	tries := 1
+	if idempotent(method) {
+		tries = maxTries
+	}
+
+	var err error
+	for i := 0; i < tries; i++ {
+		if i > 0 {
+			time.Sleep(retryWait << uint(i-1))
+		}
+		var data []byte
+		data, err = c.do(method, endpoint, body)
+		if err == nil {
+			return data, nil
+		}
+		if !Retryable(err) {
+			break
+		}
+	}
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		d.PF(2, "Request failed: %v, body was \n%v", err, serr.Body)
+	} else {
+		d.PF(2, "Request failed: %v", err)
+	}
+	return nil, err
+}
+
+func (c *Client) do(method, endpoint string, body []byte) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, endpoint, r)
+	if err != nil {
+		return nil, &Error{Method: method, Endpoint: endpoint, Err: stripURL(err)}
+	}
+	if err := authorize(req, body, &c.cfg.Get().Website); err != nil {
+		return nil, &Error{Method: method, Endpoint: endpoint, Err: err}
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, &Error{Method: method, Endpoint: endpoint, Err: stripURL(err)}
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, &StatusError{Method: method, Endpoint: endpoint, StatusCode: res.StatusCode, Body: string(data)}
+	}
+	if err != nil {
+		return nil, &Error{Method: method, Endpoint: endpoint, Err: err}
+	}
+	return data, nil
+}
+
+// stripURL drops the url from the errors of the http client, it carries the
+// private key
+func stripURL(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return uerr.Err
+	}
+	return err
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Retryable reports whether err may go away by sending the request again, it
+// is false for the responses the website refused
+func Retryable(err error) bool {
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.StatusCode >= 500 || serr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
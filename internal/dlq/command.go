@@ -0,0 +1,91 @@
+package dlq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// ErrUsage is returned by Command for bad arguments
+var ErrUsage = errors.New("usage: dlq list | dlq show <id> | dlq replay --id <id> | dlq replay --all")
+
+// Sender delivers a payload to the website
+type Sender func(url string, body []byte) error
+
+// Command runs the dlq subcommand, args are the arguments after "dlq"
+func Command(s *Store, args []string, out io.Writer, send Sender) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := s.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tFAILED\tATTEMPTS\tSTATUS\tURL\tERROR")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", e.ID, e.Failed.Format("2006-01-02 15:04:05"), e.Attempts, e.StatusCode, e.URL, e.Error)
+		}
+		return w.Flush()
+	case "show":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		e, err := s.Get(args[1])
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	case "replay":
+		return replay(s, args[1:], out, send)
+	default:
+		return ErrUsage
+	}
+}
+
+func replay(s *Store, args []string, out io.Writer, send Sender) error {
+	fs := flag.NewFlagSet("dlq replay", flag.ContinueOnError)
+	fs.SetOutput(&bytes.Buffer{})
+	id := fs.String("id", "", "the entry to replay")
+	all := fs.Bool("all", false, "replay every entry, oldest first")
+	if err := fs.Parse(args); err != nil || (*id == "") == !*all {
+		return ErrUsage
+	}
+
+	var entries []*Entry
+	if *all {
+		var err error
+		if entries, err = s.List(); err != nil {
+			return err
+		}
+	} else {
+		e, err := s.Get(*id)
+		if err != nil {
+			return err
+		}
+		entries = []*Entry{e}
+	}
+
+	var failed int
+	for _, e := range entries {
+		if err := s.Replay(e, send); err != nil {
+			fmt.Fprintf(out, "%s failed: %v\n", e.ID, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "%s delivered\n", e.ID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d entries failed", failed, len(entries))
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// Package dlq keeps the payloads the website did not accept so that they can
+// be looked at and sent again once the website is back
+package dlq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/atomicfile"
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/ids"
+	"golang.org/x/net/context"
+)
+
+const defaultDir = "deadletter"
+
+var ErrNotFound = errors.New("no such dead letter")
+
+// ResponseError is implemented by the errors of the website clients that
+// carry the response of the website
+type ResponseError interface {
+	error
+	Response() (statusCode int, body string)
+}
+
+// Entry is a payload that could not be delivered
+type Entry struct {
+	ID   string          `json:"id"`
+	URL  string          `json:"url"`
+	Body json.RawMessage `json:"body"`
+	// Error, StatusCode and Response are of the last attempt, the status
+	// code is 0 if there was no response
+	Error      string    `json:"error"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	Attempts   int       `json:"attempts"`
+	Created    time.Time `json:"created"`
+	Failed     time.Time `json:"failed"`
+}
+
+// NewEntry records the failure of delivering body to url, body has to be json
+func NewEntry(url string, body []byte, err error, attempts int) *Entry {
+	e := &Entry{
+		URL:      url,
+		Body:     json.RawMessage(body),
+		Attempts: attempts,
+		Created:  time.Now(),
+	}
+	e.setError(err)
+	return e
+}
+
+func (e *Entry) setError(err error) {
+	e.Error = err.Error()
+	e.StatusCode, e.Response = 0, ""
+	var rerr ResponseError
+	if errors.As(err, &rerr) {
+		e.StatusCode, e.Response = rerr.Response()
+	}
+	e.Failed = time.Now()
+}
+
+// Store keeps every entry in a file of its own in a directory
+type Store struct {
+	dir string
+}
+
+// Init opens the store in Website.DeadLetterDir
+func Init(ctx context.Context) context.Context {
+	dir := config.FromContext(ctx).Website.DeadLetterDir
+	if dir == "" {
+		dir = defaultDir
+	}
+	s, err := Open(dir)
+	if err != nil {
+		d.F("Could not open the dead letter store: %v", err)
+	}
+	return context.WithValue(ctx, "dlq", s)
+}
+
+func FromContext(ctx context.Context) *Store {
+	s, _ := ctx.Value("dlq").(*Store)
+	return s
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Add stores e, an entry without an id gets one, an existing entry with the
+// same id is replaced
+func (s *Store) Add(e *Entry) error {
+	if e.ID == "" {
+		e.ID = ids.New()
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	path, err := s.path(e.ID)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(path, data, 0600); err != nil {
+		return err
+	}
+	d.P("Dead lettered the payload for", e.URL, e.ID, e.Error)
+	return nil
+}
+
+// List returns every entry, oldest first
+func (s *Store) List() ([]*Entry, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(paths))
+	for _, path := range paths {
+		e, err := readEntry(path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (s *Store) Get(id string) (*Entry, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	e, err := readEntry(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return e, err
+}
+
+func (s *Store) Remove(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Replay sends e again, it is removed if the website accepts it, otherwise
+// the failure is recorded in it
+func (s *Store) Replay(e *Entry, send Sender) error {
+	err := send(e.URL, e.Body)
+	if err == nil {
+		return s.Remove(e.ID)
+	}
+	e.Attempts++
+	e.setError(err)
+	if serr := s.Add(e); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// path returns the file of the entry, ids come from the command line so they
+// must not point outside of the directory
+func (s *Store) path(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || id[0] == '.' {
+		return "", fmt.Errorf("invalid id %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func readEntry(path string) (*Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", path, err)
+	}
+	return e, nil
+}
@@ -0,0 +1,29 @@
+// Package ids creates the ids of the stored payloads and the random nonces
+// sent to twitch and the website
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var seq uint64
+
+// New returns an id that sorts by creation time, it is unique within the
+// process and safe to use as a file name
+func New() string {
+	n := atomic.AddUint64(&seq, 1)
+	return fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), n%1000000)
+}
+
+// Nonce returns 16 random bytes hex encoded
+func Nonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not read random bytes: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
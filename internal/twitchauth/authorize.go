@@ -0,0 +1,194 @@
+package twitchauth
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/ids"
+)
+
+// how long to wait for the broadcaster to authorize us
+const authorizeWait = 10 * time.Minute
+
+// BaseScopes are the scopes every broadcaster token needs, twitchscrape reads
+// the subs with it
+var BaseScopes = []string{"channel:read:subscriptions"}
+
+// the scopes the pubsub topics in the config need
+var topicScopes = map[string]string{
+	"subscriptions": "channel:read:subscriptions",
+	"bits":          "bits:read",
+	"points":        "channel:read:redemptions",
+}
+
+// TopicScope returns the scope the pubsub topic needs, topic is as in the
+// config
+func TopicScope(topic string) string {
+	return topicScopes[topic]
+}
+
+// RequiredScopes returns the scopes the token of ts needs, BaseScopes and the
+// ones of its topics
+func RequiredScopes(ts *config.TwitchScrape) []string {
+	scopes := append([]string(nil), BaseScopes...)
+	for _, topic := range ts.PubSubTopics() {
+		if s := TopicScope(topic); s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	return uniqueScopes(scopes)
+}
+
+// Scopes returns the scopes the token needs with the current config
+func (m *Manager) Scopes() []string {
+	return RequiredScopes(&m.cfg.Get().TwitchScrape)
+}
+
+// Authorize runs the authorization code flow, the broadcaster has to open the
+// url printed to out, twitch then redirects to redirect which we listen on
+// https://dev.twitch.tv/docs/authentication/getting-tokens-oauth#authorization-code-grant-flow
+func (m *Manager) Authorize(redirect string, out io.Writer) error {
+	ru, err := url.Parse(redirect)
+	if err != nil {
+		return err
+	}
+	state, err := ids.Nonce()
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", ru.Host)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", m.ClientID())
+	q.Set("redirect_uri", redirect)
+	q.Set("scope", strings.Join(m.Scopes(), " "))
+	q.Set("state", state)
+	q.Set("force_verify", "true")
+	fmt.Fprintf(out, "Open the following url as the broadcaster and authorize the application:\n\n  %s\n\n", m.authapibase()+"authorize?"+q.Encode())
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	path := ru.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var res result
+		switch {
+		case q.Get("state") != state:
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			return
+		case q.Get("error") != "":
+			res.err = fmt.Errorf("authorization failed: %s %s", q.Get("error"), q.Get("error_description"))
+		default:
+			res.code = q.Get("code")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Authorized, you can close this window.")
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(authorizeWait):
+		return fmt.Errorf("timed out waiting for the authorization")
+	}
+	if res.err != nil {
+		return res.err
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", res.code)
+	v.Set("redirect_uri", redirect)
+	return m.exchange(v)
+}
+
+// exchange requests tokens with the given grant, checks their scopes and
+// saves them
+func (m *Manager) exchange(q url.Values) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg := &m.cfg.Get().TwitchScrape
+	q.Set("client_id", cfg.ClientID)
+	// public clients, which can use the device flow, have no secret
+	if cfg.ClientSecret != "" {
+		q.Set("client_secret", cfg.ClientSecret)
+	}
+	tokens := &TokenStruct{}
+	if err := m.post("token", q, tokens); err != nil {
+		return err
+	}
+	if missing := MissingScopes(tokens.Scope, m.Scopes()); len(missing) > 0 {
+		return fmt.Errorf("the token is missing the scopes %s", strings.Join(missing, ", "))
+	}
+
+	d.DF(1, "Received OAuth Tokens")
+	m.tokens.AccessToken = tokens.AccessToken
+	m.tokens.RefreshToken = tokens.RefreshToken
+	m.expires = expiry(tokens.ExpiresIn)
+
+	unlock, err := config.LockTokensFile(m.tokensFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return config.SaveTokens(m.tokensFile, &m.tokens)
+}
+
+// MissingScopes returns the scopes of want that are not in have
+func MissingScopes(have, want []string) []string {
+	got := map[string]bool{}
+	for _, s := range have {
+		got[s] = true
+	}
+	var missing []string
+	for _, s := range want {
+		if !got[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+func uniqueScopes(scopes []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, s := range scopes {
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
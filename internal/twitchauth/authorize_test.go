@@ -0,0 +1,164 @@
+package twitchauth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+)
+
+// fakeAuth answers the token endpoint with scope and records the forms it got
+type fakeAuth struct {
+	scope string
+
+	mu    sync.Mutex
+	forms []url.Values
+}
+
+func (a *fakeAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	a.mu.Lock()
+	a.forms = append(a.forms, r.PostForm)
+	a.mu.Unlock()
+	fmt.Fprintf(w, `{"access_token":"new","refresh_token":"newrefresh","expires_in":3600,"scope":[%s]}`, a.scope)
+}
+
+func (a *fakeAuth) got() []url.Values {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]url.Values(nil), a.forms...)
+}
+
+func newTestManager(t *testing.T, srv *httptest.Server) *Manager {
+	cfg := &config.AppConfig{}
+	cfg.TwitchScrape.ClientID = "client"
+	cfg.TwitchScrape.ClientSecret = "secret"
+	cfg.TwitchScrape.AccessToken = "old"
+	cfg.TwitchScrape.RefreshToken = "oldrefresh"
+	cfg.TwitchScrape.AuthURL = srv.URL + "/"
+	cfg.TwitchScrape.TokensFile = filepath.Join(t.TempDir(), "twitchtokens")
+	h := &config.Holder{}
+	h.Set(cfg)
+	return New(h)
+}
+
+func savedTokens(t *testing.T, m *Manager) config.TwitchTokens {
+	var tokens config.TwitchTokens
+	if err := config.LoadTokens(m.tokensFile, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+// lineWriter passes everything written to it on to lines
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startAuthorize runs Authorize and returns the state of the printed url
+func startAuthorize(t *testing.T, m *Manager, redirect string) (string, chan error) {
+	out := make(lineWriter, 1)
+	done := make(chan error, 1)
+	go func() { done <- m.Authorize(redirect, out) }()
+
+	var printed string
+	select {
+	case printed = <-out:
+	case err := <-done:
+		t.Fatalf("Authorize = %v before printing the url", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no url printed")
+	}
+	for _, f := range strings.Fields(printed) {
+		if u, err := url.Parse(f); err == nil && u.Scheme == "http" {
+			q := u.Query()
+			if q.Get("redirect_uri") != redirect || q.Get("scope") != strings.Join(BaseScopes, " ") {
+				t.Fatalf("authorize url = %s", u)
+			}
+			return q.Get("state"), done
+		}
+	}
+	t.Fatalf("no url in %q", printed)
+	return "", nil
+}
+
+func redirectTo(t *testing.T, redirect, state, code string) int {
+	res, err := http.Get(redirect + "?" + url.Values{"state": {state}, "code": {code}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestAuthorize(t *testing.T) {
+	auth := &fakeAuth{scope: `"channel:read:subscriptions"`}
+	srv := httptest.NewServer(auth)
+	defer srv.Close()
+	m := newTestManager(t, srv)
+	redirect := "http://" + freeAddr(t) + "/callback"
+
+	state, done := startAuthorize(t, m, redirect)
+	if status := redirectTo(t, redirect, "forged", "evil"); status != http.StatusBadRequest {
+		t.Fatalf("state mismatch answered with %d, want 400", status)
+	}
+	if status := redirectTo(t, redirect, state, "thecode"); status != http.StatusOK {
+		t.Fatalf("redirect answered with %d", status)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// only the redirect with the right state got exchanged
+	forms := auth.got()
+	if len(forms) != 1 || forms[0].Get("code") != "thecode" || forms[0].Get("grant_type") != "authorization_code" {
+		t.Fatalf("token requests = %v", forms)
+	}
+	if m.Token() != "new" {
+		t.Fatalf("token = %q, want the new one", m.Token())
+	}
+	if tokens := savedTokens(t, m); tokens.AccessToken != "new" || tokens.RefreshToken != "newrefresh" {
+		t.Fatalf("saved %+v", tokens)
+	}
+}
+
+func TestAuthorizeMissingScopes(t *testing.T) {
+	srv := httptest.NewServer(&fakeAuth{scope: `"bits:read"`})
+	defer srv.Close()
+	m := newTestManager(t, srv)
+	redirect := "http://" + freeAddr(t) + "/"
+
+	state, done := startAuthorize(t, m, redirect)
+	redirectTo(t, redirect, state, "thecode")
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "channel:read:subscriptions") {
+		t.Fatalf("Authorize = %v, want the missing scope", err)
+	}
+	if m.Token() != "old" {
+		t.Fatalf("token = %q, want the old one kept", m.Token())
+	}
+	var tokens config.TwitchTokens
+	if err := config.LoadTokens(m.tokensFile, &tokens); err == nil {
+		t.Fatalf("saved %+v", tokens)
+	}
+}
@@ -0,0 +1,68 @@
+package twitchauth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// slowDown is added to the polling interval every time twitch asks for it
+var slowDown = 5 * time.Second
+
+// DeviceCode is the response of the device endpoint
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// AuthorizeDevice runs the device code grant flow, the broadcaster has to open
+// the url printed to out on any device, no redirect is needed
+// https://dev.twitch.tv/docs/authentication/getting-tokens-oauth#device-code-grant-flow
+func (m *Manager) AuthorizeDevice(out io.Writer) error {
+	scopes := strings.Join(m.Scopes(), " ")
+	q := url.Values{}
+	q.Set("client_id", m.ClientID())
+	q.Set("scopes", scopes)
+
+	dc := &DeviceCode{}
+	if err := m.post("device", q, dc); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Open %s as the broadcaster and enter the code %s\n", dc.VerificationURI, dc.UserCode)
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		v := url.Values{}
+		v.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		v.Set("device_code", dc.DeviceCode)
+		v.Set("scopes", scopes)
+		err := m.exchange(v)
+
+		var serr *StatusError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &serr) && strings.Contains(serr.Body, "authorization_pending"):
+			continue
+		case errors.As(err, &serr) && strings.Contains(serr.Body, "slow_down"):
+			interval += slowDown
+			continue
+		default:
+			return err
+		}
+	}
+	return fmt.Errorf("the device code expired before it was authorized")
+}
@@ -0,0 +1,87 @@
+package twitchauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeDevice(t *testing.T) {
+	slowDown = 200 * time.Millisecond
+	defer func() { slowDown = 5 * time.Second }()
+
+	var mu sync.Mutex
+	var polls []time.Time
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("scopes") != strings.Join(BaseScopes, " ") {
+			http.Error(w, "bad scopes", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"device_code":"dev","user_code":"ABCD","verification_uri":"https://www.twitch.tv/activate","expires_in":60,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("device_code") != "dev" {
+			http.Error(w, "bad device code", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		polls = append(polls, time.Now())
+		n := len(polls)
+		mu.Unlock()
+		switch n {
+		case 1:
+			http.Error(w, `{"status":400,"message":"authorization_pending"}`, http.StatusBadRequest)
+		case 2:
+			http.Error(w, `{"status":400,"message":"slow_down"}`, http.StatusBadRequest)
+		default:
+			w.Write([]byte(`{"access_token":"new","refresh_token":"newrefresh","scope":["channel:read:subscriptions"]}`))
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	m := newTestManager(t, srv)
+
+	out := &strings.Builder{}
+	if err := m.AuthorizeDevice(out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "ABCD") {
+		t.Fatalf("printed %q, want the user code", out.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(polls) != 3 {
+		t.Fatalf("polled %d times, want 3", len(polls))
+	}
+	if gap := polls[1].Sub(polls[0]); gap < time.Second {
+		t.Fatalf("polled again after %s, want the interval", gap)
+	}
+	if gap := polls[2].Sub(polls[1]); gap < time.Second+slowDown {
+		t.Fatalf("polled again after %s, want the interval slowed down", gap)
+	}
+	if tokens := savedTokens(t, m); tokens.AccessToken != "new" || tokens.RefreshToken != "newrefresh" {
+		t.Fatalf("saved %+v", tokens)
+	}
+}
+
+func TestAuthorizeDeviceDenied(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"device_code":"dev","user_code":"ABCD","expires_in":60,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"status":400,"message":"access_denied"}`, http.StatusBadRequest)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	err := newTestManager(t, srv).AuthorizeDevice(&strings.Builder{})
+	if err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Fatalf("AuthorizeDevice = %v, want the denial", err)
+	}
+}
@@ -0,0 +1,317 @@
+// Package twitchauth keeps the twitch user access token of the broadcaster
+// fresh, it is shared by twitchscrape and twitchpubsub
+// https://dev.twitch.tv/docs/authentication/refresh-tokens
+// https://dev.twitch.tv/docs/authentication/validate-tokens
+package twitchauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"golang.org/x/net/context"
+)
+
+const (
+	authUri = "https://id.twitch.tv/oauth2/"
+	// twitch requires validating the token at least once an hour
+	validateInterval = time.Hour
+	// refresh this long before the token would expire
+	refreshMargin = 5 * time.Minute
+)
+
+var (
+	// ErrRefreshRevoked means the refresh token is no longer usable, the
+	// broadcaster has to authorize again
+	ErrRefreshRevoked = errors.New("refresh token revoked")
+	ErrDecode         = errors.New("could not decode response")
+)
+
+// StatusError is returned when twitch responds with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non-200 statuscode received from twitch %d: %s", e.StatusCode, e.Body)
+}
+
+type TokenStruct struct {
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token"`
+	ExpiresIn    int      `json:"expires_in"`
+	Scope        []string `json:"scope"`
+}
+
+// Validation is the response of the validate endpoint
+type Validation struct {
+	ClientID  string   `json:"client_id"`
+	Login     string   `json:"login"`
+	UserID    string   `json:"user_id"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+// Manager hands out the current access token and refreshes it, refreshes
+// are serialized so concurrent callers do not burn the single use refresh
+// token twice
+type Manager struct {
+	cfg    *config.Holder
+	client *http.Client
+	// tokensFile is where the tokens were read from on startup
+	tokensFile string
+
+	mu      sync.Mutex
+	tokens  config.TwitchTokens
+	expires time.Time
+}
+
+// New creates a manager starting out with the tokens read by config.Init,
+// the client credentials are taken from the current config on every call,
+// the tls settings only once here
+func New(cfg *config.Holder) *Manager {
+	ts := &cfg.Get().TwitchScrape
+	tlsConfig, err := ts.TLS.Config()
+	if err != nil {
+		d.F("invalid twitchscrape.tls: %v", err)
+	}
+	return &Manager{
+		cfg:        cfg,
+		tokensFile: ts.TokensFile,
+		tokens: config.TwitchTokens{
+			AccessToken:  ts.AccessToken,
+			RefreshToken: ts.RefreshToken,
+		},
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:       tlsConfig,
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		},
+	}
+}
+
+// Init creates the manager and starts validating the token in the background
+func Init(ctx context.Context) context.Context {
+	m := New(config.HolderFromContext(ctx))
+	go m.run()
+	return context.WithValue(ctx, "twitchauth", m)
+}
+
+func FromContext(ctx context.Context) *Manager {
+	m, _ := ctx.Value("twitchauth").(*Manager)
+	return m
+}
+
+// Token returns the current access token
+func (m *Manager) Token() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tokens.AccessToken
+}
+
+// ClientID returns the client id the tokens belong to
+func (m *Manager) ClientID() string {
+	return m.cfg.Get().TwitchScrape.ClientID
+}
+
+func (m *Manager) authapibase() string {
+	if u := m.cfg.Get().TwitchScrape.AuthURL; u != "" {
+		return u
+	}
+	return authUri
+}
+
+// Refresh unconditionally refreshes the access token
+func (m *Manager) Refresh() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refreshLocked()
+}
+
+// Renew refreshes the access token unless it already changed from stale,
+// callers pass the token twitch rejected so that only one of them refreshes
+func (m *Manager) Renew(stale string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens.AccessToken != stale {
+		return nil
+	}
+	return m.refreshLocked()
+}
+
+func (m *Manager) refreshLocked() error {
+	// the other binary could have refreshed already, in which case our
+	// refresh token is used up and the new tokens are in the file
+	unlock, err := config.LockTokensFile(m.tokensFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	stale := m.tokens.AccessToken
+	if err := config.LoadTokens(m.tokensFile, &m.tokens); err == nil && m.tokens.AccessToken != stale {
+		d.DF(1, "access token was refreshed by another process")
+		return nil
+	}
+
+	d.DF(1, "renewing access token")
+	cfg := &m.cfg.Get().TwitchScrape
+	q := url.Values{}
+	q.Add("grant_type", "refresh_token")
+	q.Add("refresh_token", m.tokens.RefreshToken)
+	q.Add("client_id", cfg.ClientID)
+	q.Add("client_secret", cfg.ClientSecret)
+
+	tokens := &TokenStruct{}
+	err = m.post("token", q, tokens)
+	var serr *StatusError
+	// twitch answers a revoked or already used refresh token with 400
+	if errors.As(err, &serr) && (serr.StatusCode == http.StatusBadRequest || serr.StatusCode == http.StatusUnauthorized) {
+		err = fmt.Errorf("%w: %v", ErrRefreshRevoked, err)
+	}
+	if err != nil {
+		d.P("Failed to refresh the auth token, err", err)
+		return err
+	}
+
+	d.DF(1, "Updated OAuth Tokens")
+	m.tokens.RefreshToken = tokens.RefreshToken
+	m.tokens.AccessToken = tokens.AccessToken
+	m.expires = expiry(tokens.ExpiresIn)
+	if err := config.SaveTokens(m.tokensFile, &m.tokens); err != nil {
+		d.P("Failed to save the auth tokens, err", err)
+		return err
+	}
+	return nil
+}
+
+// Validate checks the access token with twitch and refreshes it if twitch
+// no longer accepts it
+func (m *Manager) Validate() (*Validation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, err := m.validateLocked()
+	var serr *StatusError
+	if errors.As(err, &serr) && serr.StatusCode == http.StatusUnauthorized {
+		if err := m.refreshLocked(); err != nil {
+			return nil, err
+		}
+		v, err = m.validateLocked()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (m *Manager) validateLocked() (*Validation, error) {
+	req, err := http.NewRequest("GET", m.authapibase()+"validate", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "OAuth "+m.tokens.AccessToken)
+
+	v := &Validation{}
+	if err := m.do(req, v); err != nil {
+		return nil, err
+	}
+	m.expires = expiry(v.ExpiresIn)
+	d.DF(1, "validated token of %s, expires in %ds", v.Login, v.ExpiresIn)
+	return v, nil
+}
+
+// AppToken fetches an app access token with the client credentials grant
+// https://dev.twitch.tv/docs/authentication/getting-tokens-oauth#client-credentials-grant-flow
+func (m *Manager) AppToken() (string, error) {
+	cfg := &m.cfg.Get().TwitchScrape
+	q := url.Values{}
+	q.Add("grant_type", "client_credentials")
+	q.Add("client_id", cfg.ClientID)
+	q.Add("client_secret", cfg.ClientSecret)
+
+	tokens := &TokenStruct{}
+	if err := m.post("token", q, tokens); err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// run validates the token on startup and every validateInterval, and
+// refreshes it before it expires
+func (m *Manager) run() {
+	for {
+		if _, err := m.Validate(); err != nil {
+			d.P("Failed to validate the auth token", err)
+		}
+
+		wait := validateInterval
+		m.mu.Lock()
+		// a zero expires_in means the token does not expire
+		if !m.expires.IsZero() {
+			if dur := time.Until(m.expires) - refreshMargin; dur < wait {
+				wait = dur
+			}
+		}
+		m.mu.Unlock()
+
+		if wait <= 0 {
+			if err := m.Refresh(); err != nil {
+				wait = time.Minute
+			} else {
+				continue
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// expiry returns when a token expiring in the given seconds expires, the zero
+// time if it does not expire
+func expiry(seconds int) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+func (m *Manager) post(path string, q url.Values, v interface{}) error {
+	req, err := http.NewRequest("POST", m.authapibase()+path, strings.NewReader(q.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return m.do(req, v)
+}
+
+func (m *Manager) do(req *http.Request, v interface{}) error {
+	d.DF(1, "Calling %s", req.URL)
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return &StatusError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return nil
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"github.com/destinygg/twitch-subscriber-sync/internal/config"
 	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/dlq"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
 	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/api"
+	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/queue"
 	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/twitch"
 	"golang.org/x/net/context"
 )
@@ -13,7 +22,66 @@ func main() {
 	time.Local = time.UTC
 	ctx := context.Background()
 	ctx = config.Init(ctx)
+
+	err := config.FromContext(ctx).Validate(config.AppTwitchPubSub)
+	if flag.Arg(0) == "check-config" {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config ok")
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := config.ReadTokens(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	ctx = d.Init(ctx)
+	ctx = dlq.Init(ctx)
 	ctx = api.Init(ctx)
+	if flag.Arg(0) == "dlq" {
+		os.Exit(deadLetters(ctx, flag.Args()))
+	}
+
+	// the channel blocks get their tokens when the topics are set up
+	if len(config.FromContext(ctx).ChannelNames()) == 0 {
+		ctx = twitchauth.Init(ctx)
+	}
+	ctx = queue.Init(ctx)
+	go watchReload(ctx)
 	ctx = twitch.Init(ctx)
+}
+
+func deadLetters(ctx context.Context, args []string) int {
+	err := dlq.Command(dlq.FromContext(ctx), args[1:], os.Stdout, api.FromContext(ctx).SendToApi)
+	switch {
+	case errors.Is(err, dlq.ErrUsage):
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// watchReload reloads the config on SIGHUP without dropping the connection to
+// twitch, an invalid config is logged and the old one kept
+func watchReload(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		cfg, err := config.Reload(ctx, config.AppTwitchPubSub)
+		if err != nil {
+			d.P("Could not reload the config, keeping the old one: ", err)
+			continue
+		}
+		d.SetDebugging(cfg.Debug.Debug)
+		d.P("Reloaded the config")
+	}
 }
\ No newline at end of file
@@ -0,0 +1,300 @@
+// Package queue keeps the events bound for the website on disk until the
+// website accepted them, so that an outage of the website loses nothing
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/atomicfile"
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/dlq"
+	"github.com/destinygg/twitch-subscriber-sync/internal/ids"
+	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/api"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultDir         = "queue"
+	defaultMaxAttempts = 20
+	// the backoff of failed deliveries doubles from minRetry up to maxRetry
+	minRetry = time.Second
+	maxRetry = 5 * time.Minute
+)
+
+// Event is a single delivery to the website
+type Event struct {
+	// ID orders the events, it is also the name of the file of the event
+	ID string `json:"id"`
+	// Key is the user the event is about, or the id for events without one,
+	// the events of a user are delivered in order
+	Key      string          `json:"key"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Created  time.Time       `json:"created"`
+}
+
+// Sender delivers events, only a nil error acknowledges them
+type Sender interface {
+	SendToApi(url string, body []byte) error
+}
+
+// Queue delivers the events one at a time in the order they were pushed, an
+// event failing only holds back the later events of the same key
+type Queue struct {
+	dir string
+	// events failing maxAttempts times are moved to dlq
+	dlq         *dlq.Store
+	maxAttempts int
+
+	mu     sync.Mutex
+	events []*Event
+	// retry is when the oldest event of a key may be tried again
+	retry map[string]time.Time
+	wake  chan struct{}
+}
+
+// Init opens the queue and starts delivering the events left over from the
+// last run through the api in ctx
+func Init(ctx context.Context) context.Context {
+	cfg := config.FromContext(ctx)
+	dir := cfg.TwitchPubSub.QueueDir
+	if dir == "" {
+		dir = defaultDir
+	}
+	q, err := Open(dir)
+	if err != nil {
+		d.F("Could not open the queue: %v", err)
+	}
+	q.dlq = dlq.FromContext(ctx)
+	q.maxAttempts = cfg.TwitchPubSub.MaxAttempts
+	if q.maxAttempts <= 0 {
+		q.maxAttempts = defaultMaxAttempts
+	}
+	go q.Run(api.FromContext(ctx))
+	return context.WithValue(ctx, "queue", q)
+}
+
+func FromContext(ctx context.Context) *Queue {
+	q, _ := ctx.Value("queue").(*Queue)
+	return q
+}
+
+// Open loads the events stored in dir
+func Open(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:   dir,
+		retry: map[string]time.Time{},
+		wake:  make(chan struct{}, 1),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		e, err := readEvent(path)
+		if err != nil {
+			return nil, err
+		}
+		q.events = append(q.events, e)
+	}
+	sort.Slice(q.events, func(i, j int) bool {
+		return q.events[i].ID < q.events[j].ID
+	})
+	if len(q.events) > 0 {
+		d.P("Replaying queued events: ", len(q.events))
+	}
+	return q, nil
+}
+
+// Push stores the event on disk before returning, body has to be json, an
+// empty key orders the event only by itself
+func (q *Queue) Push(key, url string, body []byte) error {
+	e := &Event{
+		ID:      ids.New(),
+		Key:     key,
+		URL:     url,
+		Body:    json.RawMessage(body),
+		Created: time.Now(),
+	}
+	if e.Key == "" {
+		// events without a user, anonymous gifts for example, must not wait
+		// behind each other
+		e.Key = e.ID
+	}
+
+	if err := q.save(e); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.events = append(q.events, e)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the events through s, it never returns
+func (q *Queue) Run(s Sender) {
+	for {
+		e, wait := q.next()
+		if e == nil {
+			q.sleep(wait)
+			continue
+		}
+
+		err := s.SendToApi(e.URL, e.Body)
+		if err == nil {
+			q.ack(e)
+			continue
+		}
+		if q.dlq != nil && e.Attempts+1 >= q.maxAttempts {
+			q.deadLetter(e, err)
+			continue
+		}
+		dur := q.fail(e)
+		d.P("Delivery failed, retrying in: ", dur, e.ID, e.Attempts, err)
+	}
+}
+
+// next returns the oldest event that may be delivered now, or how long to
+// wait for one, a zero wait means until something is pushed
+func (q *Queue) next() (*Event, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var wait time.Duration
+	blocked := map[string]bool{}
+	for _, e := range q.events {
+		if blocked[e.Key] {
+			continue
+		}
+		// only the oldest event of a key may go, the rest wait behind it
+		blocked[e.Key] = true
+		if dur := time.Until(q.retry[e.Key]); dur > 0 {
+			if wait == 0 || dur < wait {
+				wait = dur
+			}
+			continue
+		}
+		return e, 0
+	}
+	return nil, wait
+}
+
+func (q *Queue) sleep(wait time.Duration) {
+	if wait == 0 {
+		<-q.wake
+		return
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-q.wake:
+	case <-t.C:
+	}
+}
+
+// ack removes a delivered event
+func (q *Queue) ack(e *Event) {
+	if err := os.Remove(q.path(e)); err != nil && !os.IsNotExist(err) {
+		d.P("Could not remove the delivered event", e.ID, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.retry, e.Key)
+	for i, qe := range q.events {
+		if qe == e {
+			q.events = append(q.events[:i], q.events[i+1:]...)
+			break
+		}
+	}
+}
+
+// deadLetter gives up on e, the later events of its key go on without it
+func (q *Queue) deadLetter(e *Event, err error) {
+	de := dlq.NewEntry(e.URL, e.Body, err, e.Attempts+1)
+	de.ID = e.ID
+	de.Created = e.Created
+	if derr := q.dlq.Add(de); derr != nil {
+		// keep it queued rather than losing it
+		d.P("Could not dead letter the event", e.ID, derr)
+		q.fail(e)
+		return
+	}
+	q.ack(e)
+}
+
+// fail records the failed attempt and returns when the key is tried again
+func (q *Queue) fail(e *Event) time.Duration {
+	q.mu.Lock()
+	e.Attempts++
+	dur := backoff(e.Attempts)
+	q.retry[e.Key] = time.Now().Add(dur)
+	q.mu.Unlock()
+
+	// the attempts are kept so that a restart does not reset the backoff
+	if err := q.save(e); err != nil {
+		d.P("Could not save the event", e.ID, err)
+	}
+	return dur
+}
+
+// backoff doubles the wait with every attempt, the jitter keeps every key
+// from retrying at once after an outage
+func backoff(attempts int) time.Duration {
+	dur := maxRetry
+	if attempts < 10 {
+		dur = minRetry << uint(attempts-1)
+		if dur > maxRetry {
+			dur = maxRetry
+		}
+	}
+	return dur/2 + time.Duration(rand.Int63n(int64(dur/2)+1))
+}
+
+func (q *Queue) path(e *Event) string {
+	return filepath.Join(q.dir, e.ID+".json")
+}
+
+// save replaces the file of the event atomically
+func (q *Queue) save(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(q.path(e), data, 0600)
+}
+
+func readEvent(path string) (*Event, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", path, err)
+	}
+	return e, nil
+}
@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSender fails the first fails[body] deliveries of a body
+type fakeSender struct {
+	mu        sync.Mutex
+	fails     map[string]int
+	delivered []string
+	attempts  map[string][]time.Time
+	done      chan string
+}
+
+func newFakeSender(fails map[string]int) *fakeSender {
+	return &fakeSender{fails: fails, attempts: map[string][]time.Time{}, done: make(chan string, 100)}
+}
+
+func (s *fakeSender) SendToApi(url string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := string(body)
+	s.attempts[b] = append(s.attempts[b], time.Now())
+	if s.fails[b] > 0 {
+		s.fails[b]--
+		return errors.New("website down")
+	}
+	s.delivered = append(s.delivered, b)
+	s.done <- b
+	return nil
+}
+
+func (s *fakeSender) wait(t *testing.T, n int) []string {
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivered %d of %d events", i, n)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.delivered...)
+}
+
+func files(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func push(t *testing.T, q *Queue, key, body string) {
+	if err := q.Push(key, "http://website/sub", []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueOrderPerKey(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first event of a fails once, b must not wait for it but the second
+	// event of a has to
+	push(t, q, "a", `"a1"`)
+	push(t, q, "b", `"b1"`)
+	push(t, q, "a", `"a2"`)
+	s := newFakeSender(map[string]int{`"a1"`: 1})
+	go q.Run(s)
+
+	got := fmt.Sprint(s.wait(t, 3))
+	if want := fmt.Sprint([]string{`"b1"`, `"a1"`, `"a2"`}); got != want {
+		t.Fatalf("delivered %s, want %s", got, want)
+	}
+
+	// the retry waited for the backoff of the first attempt
+	s.mu.Lock()
+	attempts := s.attempts[`"a1"`]
+	s.mu.Unlock()
+	if len(attempts) != 2 {
+		t.Fatalf("a1 attempted %d times, want 2", len(attempts))
+	}
+	if gap := attempts[1].Sub(attempts[0]); gap < minRetry/2 {
+		t.Fatalf("retried after %s, want at least %s", gap, minRetry/2)
+	}
+	// acked events are removed from disk
+	if paths := files(t, dir); len(paths) != 0 {
+		t.Fatalf("%d files left after delivering everything", len(paths))
+	}
+}
+
+func TestQueueEmptyKey(t *testing.T) {
+	q, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// anonymous events do not wait behind each other
+	push(t, q, "", `"anon1"`)
+	push(t, q, "", `"anon2"`)
+	if q.events[0].Key == q.events[1].Key || q.events[0].Key != q.events[0].ID {
+		t.Fatalf("keys %q and %q, want the ids", q.events[0].Key, q.events[1].Key)
+	}
+
+	s := newFakeSender(map[string]int{`"anon1"`: 1})
+	go q.Run(s)
+	if got := s.wait(t, 1); got[0] != `"anon2"` {
+		t.Fatalf("delivered %s first, want anon2", got[0])
+	}
+}
+
+func TestQueueReplay(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, "a", `"a1"`)
+	push(t, q, "b", `"b1"`)
+	push(t, q, "a", `"a2"`)
+	q.fail(q.events[0])
+	if paths := files(t, dir); len(paths) != 3 {
+		t.Fatalf("%d files, want every event on disk", len(paths))
+	}
+
+	// a restart picks the events up in the order they were pushed, with the
+	// attempts made so far
+	q, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, e := range q.events {
+		bodies = append(bodies, string(e.Body))
+	}
+	if got, want := fmt.Sprint(bodies), fmt.Sprint([]string{`"a1"`, `"b1"`, `"a2"`}); got != want {
+		t.Fatalf("replayed %s, want %s", got, want)
+	}
+	if q.events[0].Attempts != 1 || q.events[0].Key != "a" || q.events[0].URL != "http://website/sub" {
+		t.Fatalf("replayed %+v", q.events[0])
+	}
+
+	s := newFakeSender(nil)
+	go q.Run(s)
+	s.wait(t, 3)
+	if paths := files(t, dir); len(paths) != 0 {
+		t.Fatalf("%d files left after the replay", len(paths))
+	}
+}
+
+func TestQueueAck(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, "a", `"a1"`)
+	push(t, q, "b", `"b1"`)
+	e := q.events[0]
+	q.fail(e)
+
+	q.ack(e)
+	paths := files(t, dir)
+	if len(paths) != 1 || filepath.Base(paths[0]) != q.events[0].ID+".json" {
+		t.Fatalf("files %v, want only b1", paths)
+	}
+	if _, ok := q.retry["a"]; ok || len(q.events) != 1 {
+		t.Fatalf("a is still queued")
+	}
+	// acking twice, after a crash between the delivery and the remove for
+	// example, is harmless
+	q.ack(e)
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueFailSchedulesRetry(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, "a", `"a1"`)
+	push(t, q, "a", `"a2"`)
+	push(t, q, "b", `"b1"`)
+	e := q.events[0]
+
+	for attempts := 1; attempts <= 3; attempts++ {
+		dur := q.fail(e)
+		if e.Attempts != attempts {
+			t.Fatalf("attempts = %d, want %d", e.Attempts, attempts)
+		}
+		if until := time.Until(q.retry["a"]); until > dur || until < dur-time.Second {
+			t.Fatalf("retry in %s, want %s", until, dur)
+		}
+		// the key waits, the other keys do not
+		if next, wait := q.next(); next == nil || next.Key != "b" || wait != 0 {
+			t.Fatalf("next = %+v, want b1", next)
+		}
+
+		// the attempts are saved so that a restart keeps the backoff
+		saved := &Event{}
+		data, err := ioutil.ReadFile(q.path(e))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, saved); err != nil || saved.Attempts != attempts {
+			t.Fatalf("saved %+v, %v", saved, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, minRetry},
+		{2, 2 * minRetry},
+		{5, 16 * minRetry},
+		{9, 256 * minRetry},
+		{10, maxRetry},
+		{100, maxRetry},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if dur := backoff(tt.attempts); dur < tt.max/2 || dur > tt.max {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempts, dur, tt.max/2, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package twitch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/queue"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// twitch eventsub
+	eventSubUri      = "wss://eventsub.wss.twitch.tv/ws"
+	helixUri         = "https://api.twitch.tv/helix/"
+	eventSubMaxSize  = 64 * 1024
+	welcomeWait      = 10 * time.Second
+	keepaliveGrace   = 5 * time.Second
+	defaultKeepalive = 10 * time.Second
+	seenTTL          = 10 * time.Minute
+
+	msgTypeWelcome      = "session_welcome"
+	msgTypeKeepalive    = "session_keepalive"
+	msgTypeNotification = "notification"
+	msgTypeReconnect    = "session_reconnect"
+	msgTypeRevocation   = "revocation"
+
+	subTypeSubscribe = "channel.subscribe"
+	subTypeMessage   = "channel.subscription.message"
+	subTypeGift      = "channel.subscription.gift"
+	subTypeEnd       = "channel.subscription.end"
+)
+
+// eventSubURL returns the endpoint the events of subType are sent to, an
+// empty url means the type is not subscribed to
+func eventSubURL(ts *config.TwitchScrape, subType string) string {
+	switch subType {
+	case subTypeSubscribe, subTypeMessage:
+		return ts.SubURL
+	case subTypeGift:
+		return ts.GiftURL
+	case subTypeEnd:
+		return ts.SubEndURL
+	}
+	return ""
+}
+
+// eventSubTypes returns the subscription types we create for the configured
+// channel
+func eventSubTypes(ts *config.TwitchScrape) []string {
+	var types []string
+	for _, typ := range []string{subTypeSubscribe, subTypeMessage, subTypeGift, subTypeEnd} {
+		if eventSubURL(ts, typ) != "" {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+type EventSub struct {
+	cfg     *config.Holder
+	wsurl   string
+	apibase string
+	auth    *twitchauth.Manager
+	client  *http.Client
+	dialer  *websocket.Dialer
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	tries   float64
+	closing bool
+	seen    *seenIDs
+}
+
+type EventSubMessage struct {
+	Metadata struct {
+		MessageID        string `json:"message_id"`
+		MessageType      string `json:"message_type"`
+		MessageTimestamp string `json:"message_timestamp"`
+		SubscriptionType string `json:"subscription_type"`
+	} `json:"metadata"`
+	Payload EventSubPayload `json:"payload"`
+}
+
+type EventSubPayload struct {
+	Session struct {
+		ID                      string `json:"id"`
+		Status                  string `json:"status"`
+		KeepaliveTimeoutSeconds int    `json:"keepalive_timeout_seconds"`
+		ReconnectURL            string `json:"reconnect_url"`
+	} `json:"session"`
+	Subscription struct {
+		ID     string `json:"id"`
+		Type   string `json:"type"`
+		Status string `json:"status"`
+	} `json:"subscription"`
+	Event json.RawMessage `json:"event"`
+}
+
+// EventSubEvent is the union of the fields of the subscription related events
+// https://dev.twitch.tv/docs/eventsub/eventsub-reference#events
+type EventSubEvent struct {
+	UserID               string `json:"user_id"`
+	UserLogin            string `json:"user_login"`
+	UserName             string `json:"user_name"`
+	BroadcasterUserID    string `json:"broadcaster_user_id"`
+	BroadcasterUserLogin string `json:"broadcaster_user_login"`
+	Tier                 string `json:"tier"`
+	IsGift               bool   `json:"is_gift"`
+	IsAnonymous          bool   `json:"is_anonymous"`
+	Total                int    `json:"total"`
+	CumulativeTotal      int    `json:"cumulative_total"`
+	CumulativeMonths     int    `json:"cumulative_months"`
+	StreakMonths         int    `json:"streak_months"`
+	DurationMonths       int    `json:"duration_months"`
+	Message              struct {
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// SubscribeMessageData mirrors the payload the pubsub listener used to relay
+// to the website, so the website does not have to care about the transport
+type SubscribeMessageData struct {
+	UserName         string                 `json:"user_name"`
+	DisplayName      string                 `json:"display_name"`
+	ChannelName      string                 `json:"channel_name"`
+	UserID           string                 `json:"user_id"`
+	ChannelID        string                 `json:"channel_id"`
+	Time             string                 `json:"time"`
+	SubPlan          string                 `json:"sub_plan"`
+	Months           int                    `json:"months,omitempty"`
+	CumulativeMonths int                    `json:"cumulative_months,omitempty"`
+	StreakMonths     int                    `json:"streak_months,omitempty"`
+	GiftTotal        int                    `json:"gift_total,omitempty"`
+	IsGift           bool                   `json:"is_gift"`
+	IsAnonymous      bool                   `json:"is_anonymous,omitempty"`
+	Context          string                 `json:"context"`
+	EventType        string                 `json:"event_type"`
+	SubMessage       map[string]interface{} `json:"sub_message,omitempty"`
+	// the recipient of a gift, the user fields are the gifter then
+	RecipientID          string `json:"recipient_id,omitempty"`
+	RecipientUserName    string `json:"recipient_user_name,omitempty"`
+	RecipientDisplayName string `json:"recipient_display_name,omitempty"`
+}
+
+// NewEventSub creates the eventsub client, the urls and the tls settings are
+// read once here, a reload only changes the channel and the credentials used
+// for subscribing
+func NewEventSub(h *config.Holder, auth *twitchauth.Manager) *EventSub {
+	cfg := h.Get()
+	client, dialer := clients(h)
+	c := &EventSub{
+		cfg:     h,
+		wsurl:   eventSubUri,
+		apibase: helixUri,
+		auth:    auth,
+		client:  client,
+		dialer:  dialer,
+		seen:    newSeenIDs(seenTTL),
+	}
+	if cfg.TwitchPubSub.EventSubURL != "" {
+		c.wsurl = cfg.TwitchPubSub.EventSubURL
+	}
+	if cfg.TwitchPubSub.HelixURL != "" {
+		c.apibase = cfg.TwitchPubSub.HelixURL
+	}
+	if s := cfg.TwitchPubSub.KeepaliveSeconds; s > 0 {
+		u, err := url.Parse(c.wsurl)
+		if err == nil {
+			q := u.Query()
+			q.Set("keepalive_timeout_seconds", strconv.Itoa(s))
+			u.RawQuery = q.Encode()
+			c.wsurl = u.String()
+		}
+	}
+	return c
+}
+
+func (c *EventSub) run(q *queue.Queue) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		c.loop(q)
+	}()
+
+	select {
+	case <-done:
+	case <-interrupt:
+		d.DF(1, "interrupted")
+		c.mu.Lock()
+		c.closing = true
+		conn := c.conn
+		c.mu.Unlock()
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(closeWait))
+			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			if err != nil {
+				d.DF(1, "write close: %v", err)
+			}
+			select {
+			case <-done:
+			case <-time.After(closeWait):
+			}
+			conn.Close()
+		}
+		d.DF(1, "connection closed")
+	}
+}
+
+func (c *EventSub) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+func (c *EventSub) loop(q *queue.Queue) {
+	u := c.wsurl
+	var old *websocket.Conn
+	for !c.isClosing() {
+		next, conn, err := c.serve(u, old, q)
+		if c.isClosing() {
+			return
+		}
+		if err != nil {
+			d.DF(1, "eventsub error: %+v", err)
+			if conn != nil {
+				conn.Close()
+			}
+			c.backoff()
+			u, old = c.wsurl, nil
+			continue
+		}
+		// twitch asked us to move to a different url, the subscriptions
+		// carry over so only close the old connection once welcomed
+		d.DF(1, "reconnecting to %s", next)
+		u, old = next, conn
+	}
+}
+
+func (c *EventSub) backoff() {
+	if c.tries > 10.0 {
+		c.tries = 10.0
+	}
+	dur := time.Duration(math.Pow(2.0, c.tries)*300) * time.Millisecond
+	d.DF(1, "reconnecting in %s", dur)
+	time.Sleep(dur)
+	c.tries++
+}
+
+// serve dials u, waits for the welcome message and relays notifications until
+// the connection fails or twitch asks us to reconnect, in which case the
+// reconnect url is returned together with the still open connection
+// old is the connection being replaced on a reconnect, it gets closed after
+// the welcome arrives on the new connection and no subscriptions are created
+func (c *EventSub) serve(u string, old *websocket.Conn, q *queue.Queue) (string, *websocket.Conn, error) {
+	d.DF(1, "connecting: %s", u)
+	conn, _, err := c.dialer.Dial(u, nil)
+	if err != nil {
+		if old != nil {
+			old.Close()
+		}
+		return "", nil, err
+	}
+	conn.SetReadLimit(eventSubMaxSize)
+
+	conn.SetReadDeadline(time.Now().Add(welcomeWait))
+	m, err := c.read(conn)
+	if old != nil {
+		old.Close()
+	}
+	if err != nil {
+		return "", conn, err
+	}
+	if m.Metadata.MessageType != msgTypeWelcome {
+		return "", conn, fmt.Errorf("expected %s, got %s", msgTypeWelcome, m.Metadata.MessageType)
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	keepalive := time.Duration(m.Payload.Session.KeepaliveTimeoutSeconds) * time.Second
+	if keepalive <= 0 {
+		keepalive = defaultKeepalive
+	}
+	d.DF(1, "session %s welcomed, keepalive %s", m.Payload.Session.ID, keepalive)
+
+	if old == nil {
+		if err := c.subscribeAll(m.Payload.Session.ID); err != nil {
+			return "", conn, err
+		}
+	}
+	c.tries = 0
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(keepalive + keepaliveGrace))
+		m, err := c.read(conn)
+		if err != nil {
+			return "", conn, err
+		}
+
+		switch m.Metadata.MessageType {
+		case msgTypeKeepalive:
+		case msgTypeReconnect:
+			return m.Payload.Session.ReconnectURL, conn, nil
+		case msgTypeRevocation:
+			d.P("subscription revoked", m.Payload.Subscription.Type, m.Payload.Subscription.Status)
+		case msgTypeNotification:
+			if c.seen.Seen(m.Metadata.MessageID) {
+				d.DF(1, "duplicate message %s", m.Metadata.MessageID)
+				continue
+			}
+			url := eventSubURL(&c.cfg.Get().TwitchScrape, m.Payload.Subscription.Type)
+			if url == "" {
+				d.DF(1, "no url for %s, dropping %s", m.Payload.Subscription.Type, m.Metadata.MessageID)
+				continue
+			}
+			relay(q, url, m.Payload.Subscription.Type, m.Metadata.MessageTimestamp, m.Payload.Event)
+		default:
+			d.DF(1, "Unsupported message: %+v", m)
+		}
+	}
+}
+
+func (c *EventSub) read(conn *websocket.Conn) (*EventSubMessage, error) {
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	d.DF(1, "<- %s", message)
+	m := &EventSubMessage{}
+	if err := json.Unmarshal(message, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// relay translates the event and queues it for the website
+func relay(q *queue.Queue, url, subType, timestamp string, raw json.RawMessage) error {
+	msg, err := newSubscribeMessage(subType, timestamp, raw)
+	if err != nil {
+		d.P("Failed to decode event", subType, err)
+		return err
+	}
+	buf := &bytes.Buffer{}
+	json.NewEncoder(buf).Encode(msg)
+	d.DF(1, "Data %s", buf)
+	if err := q.Push(userKey(buf.Bytes()), url, buf.Bytes()); err != nil {
+		d.P("Failed to queue event", subType, err)
+		return err
+	}
+	return nil
+}
+
+// newSubscribeMessage translates an eventsub event into the legacy format
+func newSubscribeMessage(subType, timestamp string, raw json.RawMessage) (*SubscribeMessageData, error) {
+	ev := &EventSubEvent{}
+	if err := json.Unmarshal(raw, ev); err != nil {
+		return nil, err
+	}
+
+	msg := &SubscribeMessageData{
+		UserName:         ev.UserLogin,
+		DisplayName:      ev.UserName,
+		ChannelName:      ev.BroadcasterUserLogin,
+		UserID:           ev.UserID,
+		ChannelID:        ev.BroadcasterUserID,
+		Time:             timestamp,
+		SubPlan:          ev.Tier,
+		Months:           ev.DurationMonths,
+		CumulativeMonths: ev.CumulativeMonths,
+		StreakMonths:     ev.StreakMonths,
+		IsGift:           ev.IsGift,
+		IsAnonymous:      ev.IsAnonymous,
+		EventType:        subType,
+	}
+
+	switch subType {
+	case subTypeSubscribe:
+		msg.Context = "sub"
+		if ev.IsGift {
+			// eventsub only names the recipient, the gifter arrives in the
+			// channel.subscription.gift batch
+			msg.Context = "subgift"
+			msg.RecipientID = ev.UserID
+			msg.RecipientUserName = ev.UserLogin
+			msg.RecipientDisplayName = ev.UserName
+			msg.UserID = ""
+			msg.UserName = ""
+			msg.DisplayName = ""
+		}
+	case subTypeMessage:
+		msg.Context = "resub"
+		msg.SubMessage = map[string]interface{}{"message": ev.Message.Text}
+	case subTypeGift:
+		// the user is the gifter here, the recipients arrive as gifted
+		// channel.subscribe events
+		msg.Context = "giftbatch"
+		msg.GiftTotal = ev.Total
+	case subTypeEnd:
+		msg.Context = "subend"
+	default:
+		return nil, fmt.Errorf("unsupported subscription type %s", subType)
+	}
+	return msg, nil
+}
+
+func (c *EventSub) subscribeAll(session string) error {
+	for _, typ := range eventSubTypes(&c.cfg.Get().TwitchScrape) {
+		token := c.auth.Token()
+		err := c.subscribe(session, typ, token)
+		if err == errBadAuth {
+			if err = c.auth.Renew(token); err == nil {
+				err = c.subscribe(session, typ, c.auth.Token())
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errBadAuth = fmt.Errorf("bad auth response")
+
+func (c *EventSub) subscribe(session, typ, token string) error {
+	transport := map[string]string{"method": "websocket", "session_id": session}
+	cfg := &c.cfg.Get().TwitchScrape
+	return createSubscription(c.client, c.apibase, cfg.ClientID, token, cfg.ChannelID, typ, transport)
+}
+
+// https://dev.twitch.tv/docs/api/reference#create-eventsub-subscription
+func createSubscription(client *http.Client, apibase, clientID, token, channelID, typ string, transport map[string]string) error {
+	body := map[string]interface{}{
+		"type":      typ,
+		"version":   "1",
+		"condition": map[string]string{"broadcaster_user_id": channelID},
+		"transport": transport,
+	}
+	buf := &bytes.Buffer{}
+	json.NewEncoder(buf).Encode(body)
+
+	req, err := http.NewRequest("POST", apibase+"eventsub/subscriptions", buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Client-ID", clientID)
+	req.Header.Set("Content-Type", "application/json")
+
+	d.DF(1, "subscribing to %s", typ)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return errBadAuth
+	case res.StatusCode == http.StatusConflict: // already subscribed
+		return nil
+	case res.StatusCode < 200 || res.StatusCode >= 300:
+		return fmt.Errorf("could not subscribe to %s, status %d: %s", typ, res.StatusCode, data)
+	}
+	return nil
+}
+
+// seenIDs remembers message ids for a while so that messages twitch delivers
+// more than once are only relayed once
+type seenIDs struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	ids map[string]time.Time
+}
+
+func newSeenIDs(ttl time.Duration) *seenIDs {
+	return &seenIDs{ttl: ttl, ids: map[string]time.Time{}}
+}
+
+// Seen records the id and reports whether it was already recorded
+func (s *seenIDs) Seen(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range s.ids {
+		if now.Sub(t) > s.ttl {
+			delete(s.ids, k)
+		}
+	}
+	if _, ok := s.ids[id]; ok {
+		return true
+	}
+	s.ids[id] = now
+	return false
+}
+
+// Forget removes the id, so the next delivery of it is not treated as a dupe
+func (s *seenIDs) Forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+}
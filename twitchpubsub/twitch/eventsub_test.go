@@ -0,0 +1,232 @@
+package twitch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/queue"
+	"github.com/gorilla/websocket"
+)
+
+// fakeHelix counts the subscriptions created through it
+type fakeHelix struct {
+	mu    sync.Mutex
+	types []string
+}
+
+func (h *fakeHelix) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Type string `json:"type"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	h.mu.Lock()
+	h.types = append(h.types, body.Type)
+	h.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *fakeHelix) created() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.types...)
+}
+
+// fakeEventSub runs script on every connection and then waits for the client
+// to go away
+func fakeEventSub(script func(conn *websocket.Conn)) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		script(conn)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func sendMessage(conn *websocket.Conn, typ string, payload string) {
+	conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+		`{"metadata":{"message_id":"%s-%d","message_type":"%s","message_timestamp":"2023-01-01T00:00:00Z"},"payload":%s}`,
+		typ, time.Now().UnixNano(), typ, payload)))
+}
+
+func welcome(conn *websocket.Conn, keepalive int) {
+	sendMessage(conn, msgTypeWelcome, fmt.Sprintf(`{"session":{"id":"session","status":"connected","keepalive_timeout_seconds":%d}}`, keepalive))
+}
+
+func newTestEventSub(t *testing.T, helix *httptest.Server) (*EventSub, *queue.Queue, string) {
+	cfg := &config.AppConfig{}
+	cfg.TwitchScrape.ClientID = "client"
+	cfg.TwitchScrape.ChannelID = "1"
+	cfg.TwitchScrape.AccessToken = "token"
+	cfg.TwitchScrape.SubURL = "http://website/sub"
+	cfg.TwitchPubSub.HelixURL = helix.URL + "/"
+	h := &config.Holder{}
+	h.Set(cfg)
+
+	dir := t.TempDir()
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEventSub(h, twitchauth.New(h)), q, dir
+}
+
+func queued(t *testing.T, dir string) []*queue.Event {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var events []*queue.Event
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &queue.Event{}
+		if err := json.Unmarshal(data, e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestEventSubWelcomeAndReconnect(t *testing.T) {
+	helix := &fakeHelix{}
+	helixSrv := httptest.NewServer(helix)
+	defer helixSrv.Close()
+
+	second := fakeEventSub(func(conn *websocket.Conn) {
+		welcome(conn, 10)
+		sendMessage(conn, msgTypeReconnect, `{"session":{"id":"session","status":"reconnecting","reconnect_url":"ws://next"}}`)
+	})
+	defer second.Close()
+	first := fakeEventSub(func(conn *websocket.Conn) {
+		welcome(conn, 10)
+		sendMessage(conn, msgTypeKeepalive, `{}`)
+		sendMessage(conn, msgTypeNotification, `{"subscription":{"type":"channel.subscribe"},"event":{"user_id":"42","user_login":"someone","tier":"1000"}}`)
+		// gift batches are not subscribed to without gifturl, but must not
+		// reach suburl if they arrive anyway
+		sendMessage(conn, msgTypeNotification, `{"subscription":{"type":"channel.subscription.gift"},"event":{"user_id":"43","total":5}}`)
+		sendMessage(conn, msgTypeReconnect, fmt.Sprintf(`{"session":{"id":"session","status":"reconnecting","reconnect_url":"%s"}}`, wsURL(second)))
+	})
+	defer first.Close()
+
+	c, q, dir := newTestEventSub(t, helixSrv)
+	next, conn, err := c.serve(wsURL(first), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != wsURL(second) {
+		t.Fatalf("reconnect url = %q, want %q", next, wsURL(second))
+	}
+	want := []string{subTypeSubscribe, subTypeMessage}
+	if got := helix.created(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("subscriptions = %v, want %v", got, want)
+	}
+
+	events := queued(t, dir)
+	if len(events) != 1 {
+		t.Fatalf("queued %d events, want 1", len(events))
+	}
+	if events[0].Key != "42" || events[0].URL != "http://website/sub" {
+		t.Fatalf("queued %+v", events[0])
+	}
+
+	// the subscriptions carry over to the reconnect url, the old connection
+	// is closed once the new one is welcomed
+	next, _, err = c.serve(next, conn, q)
+	if err != nil || next != "ws://next" {
+		t.Fatalf("serve = %q, %v", next, err)
+	}
+	if got := helix.created(); len(got) != len(want) {
+		t.Fatalf("subscriptions after reconnect = %v, want %v", got, want)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("old connection still open")
+	}
+}
+
+func TestEventSubKeepaliveTimeout(t *testing.T) {
+	helixSrv := httptest.NewServer(&fakeHelix{})
+	defer helixSrv.Close()
+	srv := fakeEventSub(func(conn *websocket.Conn) {
+		welcome(conn, 1)
+	})
+	defer srv.Close()
+
+	c, q, _ := newTestEventSub(t, helixSrv)
+	start := time.Now()
+	_, conn, err := c.serve(wsURL(srv), nil, q)
+	if conn != nil {
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("serve returned without an error")
+	}
+	if dur := time.Since(start); dur > 1*time.Second+keepaliveGrace+2*time.Second {
+		t.Fatalf("took %s to notice the missing keepalive", dur)
+	}
+}
+
+func TestEventSubNoWelcome(t *testing.T) {
+	helixSrv := httptest.NewServer(&fakeHelix{})
+	defer helixSrv.Close()
+	srv := fakeEventSub(func(conn *websocket.Conn) {
+		sendMessage(conn, msgTypeKeepalive, `{}`)
+	})
+	defer srv.Close()
+
+	c, q, _ := newTestEventSub(t, helixSrv)
+	_, conn, err := c.serve(wsURL(srv), nil, q)
+	if conn != nil {
+		conn.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), msgTypeWelcome) {
+		t.Fatalf("serve = %v, want a missing welcome error", err)
+	}
+}
+
+func TestNewSubscribeMessageGift(t *testing.T) {
+	raw := `{"user_id":"42","user_login":"someone","user_name":"Someone","broadcaster_user_id":"1","broadcaster_user_login":"channel","tier":"1000","is_gift":true}`
+	msg, err := newSubscribeMessage(subTypeSubscribe, "2023-01-01T00:00:00Z", json.RawMessage(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Context != "subgift" {
+		t.Fatalf("context = %q, want subgift", msg.Context)
+	}
+	if msg.RecipientID != "42" || msg.RecipientUserName != "someone" || msg.RecipientDisplayName != "Someone" {
+		t.Fatalf("recipient = %q %q %q", msg.RecipientID, msg.RecipientUserName, msg.RecipientDisplayName)
+	}
+	// the gifter is unknown, the recipient must not be reported as one
+	if msg.UserID != "" || msg.UserName != "" || msg.DisplayName != "" {
+		t.Fatalf("gifter = %q %q %q, want none", msg.UserID, msg.UserName, msg.DisplayName)
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := userKey(body); key != "42" {
+		t.Fatalf("key = %q, want the recipient", key)
+	}
+}
@@ -0,0 +1,138 @@
+package twitch
+
+import (
+	"encoding/json"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+	"golang.org/x/net/context"
+)
+
+const (
+	// twitch pub/sub topics, the channel id is appended to them
+	// https://dev.twitch.tv/docs/pubsub#topics
+	msgBitsPrefix   = "channel-bits-events-v2"
+	msgPointsPrefix = "channel-points-channel-v1"
+
+	// the most topics twitch allows on a single connection
+	defaultMaxTopics = 50
+)
+
+// the pubsub topics of the topics in the config
+var topicPrefixes = map[string]string{
+	"subscriptions": msgEventPrefix,
+	"bits":          msgBitsPrefix,
+	"points":        msgPointsPrefix,
+}
+
+// listen is a single topic of a channel
+type listen struct {
+	topic string
+	// name is the topic as in the config
+	name string
+	cfg  *config.Holder
+	auth *twitchauth.Manager
+}
+
+// url returns the website endpoint the events of the topic are sent to
+func (l *listen) url() string {
+	_, u, _ := l.cfg.Get().TwitchScrape.TopicURL(l.name)
+	return u
+}
+
+// pubsubListens returns the topics of every configured channel, the channel
+// blocks each get a token manager of their own
+func pubsubListens(ctx context.Context) []*listen {
+	root := config.HolderFromContext(ctx)
+	holders := []*config.Holder{root}
+	if names := root.Get().ChannelNames(); len(names) > 0 {
+		holders = holders[:0]
+		for _, name := range names {
+			holders = append(holders, root.Channel(name))
+		}
+	}
+
+	var listens []*listen
+	for _, h := range holders {
+		auth := twitchauth.FromContext(ctx)
+		if h != root {
+			auth = twitchauth.FromContext(twitchauth.Init(config.WithHolder(ctx, h)))
+		}
+		ts := &h.Get().TwitchScrape
+		for _, name := range ts.PubSubTopics() {
+			listens = append(listens, &listen{
+				topic: topicPrefixes[name] + "." + ts.ChannelID,
+				name:  name,
+				cfg:   h,
+				auth:  auth,
+			})
+		}
+	}
+	return listens
+}
+
+// splitListens spreads the topics over as many connections as the limit of
+// topics per connection needs
+func splitListens(listens []*listen, max int) [][]*listen {
+	if max <= 0 {
+		max = defaultMaxTopics
+	}
+	var conns [][]*listen
+	for len(listens) > max {
+		conns = append(conns, listens[:max])
+		listens = listens[max:]
+	}
+	return append(conns, listens)
+}
+
+// listenGroup is a LISTEN frame, its topics share a token
+type listenGroup struct {
+	auth   *twitchauth.Manager
+	topics []string
+	// scopes are what the token needs for the topics
+	scopes []string
+}
+
+// groups returns a LISTEN frame for every token used by the connection
+func (c *IConn) groups() []*listenGroup {
+	var groups []*listenGroup
+	byAuth := map[*twitchauth.Manager]*listenGroup{}
+	for _, l := range c.listens {
+		g, ok := byAuth[l.auth]
+		if !ok {
+			g = &listenGroup{auth: l.auth}
+			byAuth[l.auth] = g
+			groups = append(groups, g)
+		}
+		g.topics = append(g.topics, l.topic)
+		if s := twitchauth.TopicScope(l.name); s != "" && len(twitchauth.MissingScopes(g.scopes, []string{s})) > 0 {
+			g.scopes = append(g.scopes, s)
+		}
+	}
+	return groups
+}
+
+// userKey returns the user an event is about, the recipient for gifts, the
+// events of a user are delivered in order, anonymous events have no user and
+// are keyed by their own id in the queue
+func userKey(body []byte) string {
+	var ev struct {
+		RecipientID string `json:"recipient_id"`
+		UserID      string `json:"user_id"`
+		Data        struct {
+			UserID     string `json:"user_id"`
+			Redemption struct {
+				User struct {
+					ID string `json:"id"`
+				} `json:"user"`
+			} `json:"redemption"`
+		} `json:"data"`
+	}
+	json.Unmarshal(body, &ev)
+	for _, id := range []string{ev.RecipientID, ev.UserID, ev.Data.UserID, ev.Data.Redemption.User.ID} {
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,240 @@
+package twitch
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+	"github.com/gorilla/websocket"
+)
+
+// fakePubSub answers the LISTEN frames of the nth connection with answer(n)
+type fakePubSub struct {
+	answer func(n int) string
+
+	mu      sync.Mutex
+	conns   []*websocket.Conn
+	dialed  []time.Time
+	listens int
+}
+
+func (s *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.dialed = append(s.dialed, time.Now())
+	n := len(s.conns)
+	s.mu.Unlock()
+
+	for {
+		m := &SubscribePayload{}
+		if err := conn.ReadJSON(m); err != nil {
+			return
+		}
+		if m.Type != msgTypeListen {
+			continue
+		}
+		s.mu.Lock()
+		s.listens++
+		s.mu.Unlock()
+		conn.WriteJSON(&Message{Type: msgTypeResponse, Nonce: m.Nonce, Error: s.answer(n)})
+	}
+}
+
+func (s *fakePubSub) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakePubSub) stats() ([]time.Time, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.dialed...), s.listens
+}
+
+// fakeValidate answers the validate endpoint with scopes, or 401 if scopes is
+// nil, refreshing the token always fails
+func fakeValidate(scopes []string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
+		if scopes == nil {
+			http.Error(w, `{"status":401,"message":"invalid access token"}`, http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&twitchauth.Validation{Login: "channel", UserID: "1", Scopes: scopes, ExpiresIn: 3600})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"status":400,"message":"Invalid refresh token"}`, http.StatusBadRequest)
+	})
+	return httptest.NewServer(mux)
+}
+
+// startIConn connects to srv and runs the read loop of run until the test
+// ends
+func startIConn(t *testing.T, pubsub *fakePubSub, auth *httptest.Server) *IConn {
+	srv := httptest.NewServer(pubsub)
+	cfg := &config.AppConfig{}
+	cfg.TwitchScrape.ClientID = "client"
+	cfg.TwitchScrape.ChannelID = "1"
+	cfg.TwitchScrape.AccessToken = "token"
+	cfg.TwitchScrape.RefreshToken = "refresh"
+	cfg.TwitchScrape.AuthURL = auth.URL + "/"
+	cfg.TwitchScrape.TokensFile = filepath.Join(t.TempDir(), "twitchtokens")
+	h := &config.Holder{}
+	h.Set(cfg)
+
+	l := &listen{topic: msgEventPrefix + ".1", name: "subscriptions", cfg: h, auth: twitchauth.New(h)}
+	c := NewIConn([]*listen{l}, websocket.DefaultDialer)
+	c.uri = wsURL(srv)
+	c.Reconnect()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			m, err := c.Read()
+			if err != nil && c.isClosing() {
+				return
+			}
+			if m != nil && m.Type == msgTypeResponse {
+				c.handleResponse(m)
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		c.setClosing(true)
+		pubsub.close()
+		<-done
+		srv.Close()
+	})
+	return c
+}
+
+func (c *IConn) refusedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refused
+}
+
+// waitRefused waits for the connection to be marked as failed
+func waitRefused(t *testing.T, c *IConn) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := c.refusedErr(); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the LISTEN was not refused")
+	return nil
+}
+
+func waitDialed(t *testing.T, s *fakePubSub, n int) []time.Time {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if dialed, _ := s.stats(); len(dialed) >= n {
+			return dialed
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("not reconnected %d times", n-1)
+	return nil
+}
+
+func TestPubSubBadTopicReconnects(t *testing.T) {
+	auth := fakeValidate([]string{"channel:read:subscriptions"})
+	defer auth.Close()
+	// the first two connections are refused, the third listens
+	pubsub := &fakePubSub{answer: func(n int) string {
+		if n < 3 {
+			return msgErrorBadTopic
+		}
+		return ""
+	}}
+	c := startIConn(t, pubsub, auth)
+
+	for n := 1; n < 3; n++ {
+		if err := waitRefused(t, c); !errors.Is(err, ErrListenBadTopic) {
+			t.Fatalf("connection %d refused with %v, want ErrListenBadTopic", n, err)
+		}
+		// what the check ticker does
+		c.checkListens()
+		if err := c.refusedErr(); err != nil {
+			t.Fatalf("failed state %v survived the reconnect", err)
+		}
+		waitDialed(t, pubsub, n+1)
+	}
+
+	dialed, _ := pubsub.stats()
+	if gap := dialed[1].Sub(dialed[0]); gap < 300*time.Millisecond {
+		t.Fatalf("first reconnect after %s, want the backoff", gap)
+	}
+	if gap := dialed[2].Sub(dialed[1]); gap < 600*time.Millisecond {
+		t.Fatalf("second reconnect after %s, want the backoff doubled", gap)
+	}
+
+	// the third connection listens, which starts the backoff over
+	var tries float64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		c.mu.Lock()
+		tries = c.tries
+		c.mu.Unlock()
+		if tries == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tries != 0 {
+		t.Fatalf("tries = %v after listening, want 0", tries)
+	}
+	c.checkListens()
+	if err := c.refusedErr(); err != nil {
+		t.Fatal(err)
+	}
+	if dialed, _ := pubsub.stats(); len(dialed) != 3 {
+		t.Fatalf("%d connections, want the listening one kept", len(dialed))
+	}
+}
+
+func TestPubSubBadAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		kind    error
+		listens int
+	}{
+		{"retries used up", []string{"channel:read:subscriptions"}, ErrListenBadAuth, maxListenRetries + 1},
+		{"missing scope", []string{"bits:read"}, ErrListenMissingScope, 1},
+		{"validate fails", nil, ErrListenBadAuth, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := fakeValidate(tt.scopes)
+			defer auth.Close()
+			pubsub := &fakePubSub{answer: func(int) string { return msgErrorBadAuth }}
+			c := startIConn(t, pubsub, auth)
+
+			if err := waitRefused(t, c); !errors.Is(err, tt.kind) {
+				t.Fatalf("refused with %v, want %v", err, tt.kind)
+			}
+			if _, listens := pubsub.stats(); listens != tt.listens {
+				t.Fatalf("sent %d LISTEN frames, want %d", listens, tt.listens)
+			}
+			c.checkListens()
+			waitDialed(t, pubsub, 2)
+		})
+	}
+}
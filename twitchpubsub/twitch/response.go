@@ -0,0 +1,197 @@
+package twitch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/ids"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// how long twitch has to answer a LISTEN frame
+	listenTimeout = 10 * time.Second
+	// how many times a LISTEN refused for its token is sent again
+	maxListenRetries = 3
+
+	msgErrorBadTopic = "ERR_BADTOPIC"
+	msgErrorServer   = "ERR_SERVER"
+)
+
+// the kinds of LISTEN failures, match them with errors.Is
+var (
+	ErrListenBadAuth  = errors.New("listen refused, bad auth token")
+	ErrListenBadTopic = errors.New("listen refused, bad topic")
+	ErrListenServer   = errors.New("listen failed, twitch server error")
+	ErrListenTimeout  = errors.New("listen not confirmed in time")
+	ErrListenFailed   = errors.New("listen failed")
+	// ErrListenMissingScope is a valid token without the scope a topic
+	// needs, only authorizing again helps
+	ErrListenMissingScope = errors.New("listen refused, token is missing scopes")
+)
+
+// ListenError is a LISTEN frame twitch refused or never answered
+type ListenError struct {
+	Kind   error
+	Topics []string
+	// Response is the error twitch responded with, empty on timeouts
+	Response string
+}
+
+func (e *ListenError) Error() string {
+	s := "pubsub: " + e.Kind.Error() + " for " + strings.Join(e.Topics, ", ")
+	if e.Response != "" {
+		s += ": " + e.Response
+	}
+	return s
+}
+
+func (e *ListenError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// listenError classifies the error of a RESPONSE frame
+func listenError(g *listenGroup, response string) *ListenError {
+	e := &ListenError{Topics: g.topics, Response: response}
+	switch response {
+	case msgErrorBadAuth:
+		e.Kind = ErrListenBadAuth
+	case msgErrorBadTopic:
+		e.Kind = ErrListenBadTopic
+	case msgErrorServer:
+		e.Kind = ErrListenServer
+	default:
+		e.Kind = ErrListenFailed
+	}
+	return e
+}
+
+// pendingListen is a LISTEN frame waiting for its RESPONSE
+type pendingListen struct {
+	group *listenGroup
+	sent  time.Time
+	tries int
+}
+
+// listen sends the LISTEN frame of g with a fresh nonce, the RESPONSE is
+// matched to it in handleResponse
+func (c *IConn) listen(g *listenGroup, tries int) {
+	nonce, err := ids.Nonce()
+	if err != nil {
+		d.P("Could not create a nonce", err)
+		return
+	}
+	m := &SubscribePayload{
+		Type:  msgTypeListen,
+		Nonce: nonce,
+		Data: SubscribePayloadData{
+			AuthToken: g.auth.Token(),
+			Topics:    g.topics,
+		}}
+
+	c.mu.Lock()
+	c.pending[nonce] = &pendingListen{group: g, sent: time.Now(), tries: tries}
+	c.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	json.NewEncoder(buf).Encode(m)
+	c.Write(websocket.TextMessage, buf.Bytes())
+}
+
+// handleResponse matches a RESPONSE frame to its LISTEN, refused tokens are
+// validated, which refreshes them if needed, and the LISTEN is sent again
+// unless the token lacks the scopes of the topics
+func (c *IConn) handleResponse(m *Message) {
+	c.mu.Lock()
+	p, ok := c.pending[m.Nonce]
+	delete(c.pending, m.Nonce)
+	// the backoff starts over once the connection listens to every topic
+	if ok && m.Error == "" && len(c.pending) == 0 && c.refused == nil {
+		c.tries = 0
+	}
+	c.mu.Unlock()
+	if !ok {
+		d.DF(1, "response to an unknown nonce %q", m.Nonce)
+		return
+	}
+	if m.Error == "" {
+		d.DF(1, "listening to %s", strings.Join(p.group.topics, ", "))
+		return
+	}
+
+	err := listenError(p.group, m.Error)
+	switch {
+	case errors.Is(err, ErrListenBadAuth) && p.tries < maxListenRetries:
+		d.P("LISTEN refused, validating the token", err)
+		v, verr := p.group.auth.Validate()
+		if verr != nil {
+			d.P("ALERT: the token could not be renewed, reauthorization is needed", err, verr)
+			c.refuse(err)
+			return
+		}
+		if missing := twitchauth.MissingScopes(v.Scopes, p.group.scopes); len(missing) > 0 {
+			err = &ListenError{Kind: ErrListenMissingScope, Topics: p.group.topics, Response: strings.Join(missing, ", ")}
+			d.P("ALERT: run authorize again to grant the scopes", err)
+			c.refuse(err)
+			return
+		}
+		c.listen(p.group, p.tries+1)
+	case errors.Is(err, ErrListenServer) && p.tries < maxListenRetries:
+		d.P("LISTEN failed, retrying", err)
+		c.listen(p.group, p.tries+1)
+	default:
+		d.P("ALERT: not listening to the topics", err)
+		c.refuse(err)
+	}
+}
+
+// refuse marks the connection as failed, checkListens reconnects it
+func (c *IConn) refuse(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refused == nil {
+		c.refused = err
+	}
+}
+
+// checkListens closes the connection if twitch refused a LISTEN or did not
+// answer it in time, the read loop then reconnects with a growing backoff, so
+// the alert repeats until every topic is listened to
+func (c *IConn) checkListens() {
+	err := c.expiredListen()
+	c.mu.Lock()
+	if err == nil {
+		err = c.refused
+	}
+	if err == nil {
+		c.mu.Unlock()
+		return
+	}
+	// the state belongs to the connection being closed, it must not close
+	// the next one too while the read loop waits to reconnect
+	c.pending = map[string]*pendingListen{}
+	c.refused = nil
+	conn := c.conn
+	c.mu.Unlock()
+
+	d.P("ALERT: reconnecting, not listening to every topic", err)
+	conn.Close()
+}
+
+// expiredListen returns the error of a LISTEN frame that was not answered in
+// time, nil if there is none
+func (c *IConn) expiredListen() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pending {
+		if time.Since(p.sent) > listenTimeout {
+			return &ListenError{Kind: ErrListenTimeout, Topics: p.group.topics}
+		}
+	}
+	return nil
+}
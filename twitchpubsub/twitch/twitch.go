@@ -9,14 +9,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"math"
-	"strings"
 	"github.com/destinygg/twitch-subscriber-sync/internal/config"
 	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
-	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/api"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/queue"
 	"golang.org/x/net/context"
 	"net/http"
-	"crypto/tls"
-	"fmt"
+	"sync"
 )
 
 const (
@@ -46,13 +45,28 @@ const (
 )
 
 type IConn struct {
+	uri     string
+	dialer  *websocket.Dialer
+	listens []*listen
+	// topics maps the pubsub topics to their listen
+	topics map[string]*listen
+
+	mu sync.Mutex
+	// conn is replaced by Reconnect on the read loop while run uses it too
 	conn    *websocket.Conn
-	cfg     *config.TwitchScrape
-	tries   float64
 	closing bool
+	tries   float64
+	// pending are the LISTEN frames not answered yet, keyed by their nonce
+	pending map[string]*pendingListen
+	// refused is set once twitch refused a LISTEN for good
+	refused error
+
+	// wmu serializes the writes, the connection allows only one writer
+	wmu sync.Mutex
 }
 type Message struct {
 	Type  string      `json:"type"`
+	Nonce string      `json:"nonce,omitempty"`
 	Error string      `json:"error,omitempty"`
 	Data  MessageData `json:"data,omitempty"`
 }
@@ -70,18 +84,26 @@ type SubscribePayloadData struct {
 	AuthToken string   `json:"auth_token,omitempty"`
 }
 
-type TokenStruct struct {
-	AccessToken string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	Scope []string `json:"scope"`
-}
-
-var client = &http.Client{
-	Timeout: 30 * time.Second,
-	Transport: &http.Transport{
-		TLSClientConfig:       &tls.Config{},
-		ResponseHeaderTimeout: 30 * time.Second,
-	},
+// clients returns the http client and the websocket dialer for the twitch
+// endpoints, the tls settings are read once here
+func clients(h *config.Holder) (*http.Client, *websocket.Dialer) {
+	tlsConfig, err := h.Get().TwitchScrape.TLS.Config()
+	if err != nil {
+		d.F("invalid twitchscrape.tls: %v", err)
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:       tlsConfig,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		TLSClientConfig:  tlsConfig,
+	}
+	return client, dialer
 }
 
 /*type SubscribeMessageData struct {
@@ -99,16 +121,52 @@ var client = &http.Client{
 }*/
 
 func Init(ctx context.Context) context.Context {
-	c := &IConn{
-		cfg:     &config.FromContext(ctx).TwitchScrape,
-		closing: false,
-		tries:   0,
+	h := config.HolderFromContext(ctx)
+	cfg := h.Get()
+	auth := twitchauth.FromContext(ctx)
+	// the transport is chosen once, changing it needs a restart
+	if cfg.TwitchPubSub.Transport == "webhook" {
+		w := NewWebhook(h, queue.FromContext(ctx), auth)
+		w.run()
+		return context.WithValue(ctx, "twitch", w)
 	}
-	c.run(api.FromContext(ctx))
+	if cfg.TwitchPubSub.Transport == "pubsub" {
+		var conns []*IConn
+		var wg sync.WaitGroup
+		_, dialer := clients(h)
+		for _, listens := range splitListens(pubsubListens(ctx), cfg.TwitchPubSub.MaxTopics) {
+			c := NewIConn(listens, dialer)
+			conns = append(conns, c)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.run(queue.FromContext(ctx))
+			}()
+		}
+		wg.Wait()
+		return context.WithValue(ctx, "twitch", conns)
+	}
+
+	c := NewEventSub(h, auth)
+	c.run(queue.FromContext(ctx))
 	return context.WithValue(ctx, "twitch", c)
 }
 
-func (c *IConn) run(a *api.Api) {
+func NewIConn(listens []*listen, dialer *websocket.Dialer) *IConn {
+	c := &IConn{
+		uri:     webSocketUri,
+		dialer:  dialer,
+		listens: listens,
+		topics:  map[string]*listen{},
+		pending: map[string]*pendingListen{},
+	}
+	for _, l := range listens {
+		c.topics[l.topic] = l
+	}
+	return c
+}
+
+func (c *IConn) run(q *queue.Queue) {
 	time.Local = time.UTC
 
 	interrupt := make(chan os.Signal, 1)
@@ -116,13 +174,15 @@ func (c *IConn) run(a *api.Api) {
 	done := make(chan struct{})
 
 	c.Reconnect()
-	defer c.conn.Close()
+	defer func() { c.current().Close() }()
 
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
+	check := time.NewTicker(listenTimeout / 2)
+	defer check.Stop()
 
 	go func() {
-		defer c.conn.Close()
+		defer func() { c.current().Close() }()
 		defer close(done)
 		for {
 			m, _ := c.Read()
@@ -131,20 +191,19 @@ func (c *IConn) run(a *api.Api) {
 			}
 			switch m.Type {
 			case msgTypeResponse:
-				// TODO this is a response to the subscribe frame
-				// Currently not looking at the response and assume the subscribe worked.
-				break
+				c.handleResponse(m)
 			default:
-				p := strings.Split(m.Data.Topic, ".")[0]
-				switch p {
-				case msgEventPrefix:
-					// https://dev.twitch.tv/docs/pubsub#example-channel-subscriptions-event-message
-					// msg := &SubscribeMessageData{}
-					// json.Unmarshal([]byte(m.Data.Message), &msg)
-					d.DF(1, "Data %+v", m.Data.Message)
-					a.SendSubDataToApi(strings.NewReader(m.Data.Message))
-				default:
-					d.DF(1, "Unsupported message.", m)
+				// https://dev.twitch.tv/docs/pubsub#example-channel-subscriptions-event-message
+				l, ok := c.topics[m.Data.Topic]
+				if !ok {
+					d.DF(1, "Unsupported message: %+v", m)
+					break
+				}
+				d.DF(1, "Data %+v", m.Data.Message)
+				// the event is on disk once queued, delivering it is up to
+				// the queue
+				if err := q.Push(userKey([]byte(m.Data.Message)), l.url(), []byte(m.Data.Message)); err != nil {
+					d.P("Failed to queue event", m.Data.Topic, err)
 				}
 			}
 		}
@@ -153,10 +212,11 @@ func (c *IConn) run(a *api.Api) {
 	for {
 		select {
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			c.conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"`+msgTypePing+`"}`))
+			c.writeMessage(websocket.TextMessage, []byte(`{"type":"`+msgTypePing+`"}`), writeWait)
+		case <-check.C:
+			c.checkListens()
 		case <-interrupt:
-			c.closing = true
+			c.setClosing(true)
 			d.DF(1, "interrupted")
 			if err := c.SendCloseFrame(); err != nil {
 				d.DF(1, "write close: %v", err)
@@ -166,8 +226,8 @@ func (c *IConn) run(a *api.Api) {
 			case <-done:
 			case <-time.After(closeWait):
 			}
-			c.conn.Close()
-			c.closing = false
+			c.current().Close()
+			c.setClosing(false)
 			d.DF(1, "connection closed")
 			return
 		}
@@ -175,23 +235,51 @@ func (c *IConn) run(a *api.Api) {
 }
 
 func (c *IConn) ReconnectAfterError(err error) {
+	dur := c.backoff()
+	d.DF(1, "reconnecting in %s", dur)
+	time.Sleep(dur)
+	c.Reconnect()
+}
+
+// backoff returns how long to wait before the next reconnect, it doubles
+// with every reconnect until the connection listens to every topic again
+func (c *IConn) backoff() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.tries > 10.0 {
 		c.tries = 10.0
 	}
 	dur := time.Duration(math.Pow(2.0, c.tries)*300) * time.Millisecond
-	d.DF(1, "reconnecting in %s", dur)
-	time.Sleep(dur)
 	c.tries++
-	c.Reconnect()
+	return dur
+}
+
+// current returns the connection in use
+func (c *IConn) current() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *IConn) setClosing(closing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = closing
+}
+
+func (c *IConn) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
 }
 
 func (c *IConn) Reconnect() {
-	if c.conn != nil {
-		c.conn.Close()
+	if conn := c.current(); conn != nil {
+		conn.Close()
 	}
-	u, err := url.Parse(webSocketUri)
+	u, err := url.Parse(c.uri)
 	d.DF(1, "connecting: %s", u.String())
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, _, err := c.dialer.Dial(u.String(), nil)
 	if err != nil {
 		d.DF(1, "conn error: %+v", err)
 		c.ReconnectAfterError(err)
@@ -200,39 +288,44 @@ func (c *IConn) Reconnect() {
 	conn.SetReadLimit(maxMessageSize)
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetWriteDeadline(time.Now().Add(writeWait))
-	c.conn = conn
 
-	m := &SubscribePayload{
-		Type: msgTypeListen,
-		Data: SubscribePayloadData{
-			AuthToken: c.cfg.AccessToken,
-			Topics: []string{msgEventPrefix + "." + c.cfg.ChannelID},
-		}}
-
-	buf := &bytes.Buffer{}
-	json.NewEncoder(buf).Encode(m)
-	c.Write(websocket.TextMessage, buf.Bytes())
+	// the answers to the frames sent on the old connection never arrive
+	c.mu.Lock()
+	c.conn = conn
+	c.pending = map[string]*pendingListen{}
+	c.refused = nil
+	c.mu.Unlock()
+	for _, g := range c.groups() {
+		c.listen(g, 0)
+	}
 }
 
 func (c *IConn) SendCloseFrame() error {
-	c.conn.SetWriteDeadline(time.Now().Add(closeWait))
-	return c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return c.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), closeWait)
 }
 
 func (c *IConn) Write(messageType int, data []byte) {
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	data = bytes.TrimSpace(data)
 	d.DF(1, "-> %s", data)
-	if err := c.conn.WriteMessage(messageType, data); err != nil {
+	if err := c.writeMessage(messageType, data, writeWait); err != nil {
 		d.DF(1, "write error: %+v", err)
 		c.ReconnectAfterError(err)
 	}
 }
 
+func (c *IConn) writeMessage(messageType int, data []byte, wait time.Duration) error {
+	conn := c.current()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(wait))
+	return conn.WriteMessage(messageType, data)
+}
+
 func (c *IConn) Read() (*Message, error) {
-	_, message, err := c.conn.ReadMessage()
+	conn := c.current()
+	_, message, err := conn.ReadMessage()
 	if err != nil {
-		if !c.closing {
+		if !c.isClosing() {
 			// TODO we aren't getting a valid close status after sending the close frame to twitch
 			//if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure)
 			d.DF(1, "read error: %+v", err)
@@ -246,61 +339,9 @@ func (c *IConn) Read() (*Message, error) {
 		return nil, err
 	}
 	if m.Type == msgTypePong {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil, nil // return nil so that the message is not "handled"
 	}
-	if m.Error == msgErrorBadAuth {
-		d.DF(1, "bad authentication %s", m)
-		c.Auth()
-		return nil, fmt.Errorf("bad auth response")
-	}
 	d.DF(1, "<- %s", m)
 	return m, err
 }
-
-func (c *IConn) Auth() error {
-	d.DF(1, "renewing access token")
-	u, _ := url.Parse("https://api.twitch.tv/kraken/oauth2/token")
-	q := u.Query()
-	q.Add("grant_type", "refresh_token")
-	q.Add("refresh_token", c.cfg.RefreshToken)
-	q.Add("client_id", c.cfg.ClientID)
-	q.Add("client_secret", c.cfg.ClientSecret)
-	u.RawQuery = q.Encode()
-	headers := http.Header{"Accept": []string{"application/vnd.twitchtv.v5+json"}}
-	var res *http.Response
-	{
-		d.DF(1, "Calling %s", u)
-		res, err := client.Do(&http.Request{
-			Method:     "POST",
-			URL:        u,
-			Proto:      "HTTP/1.1",
-			ProtoMinor: 1,
-			Header:     headers,
-			Body:       nil,
-			Host:       u.Host,
-		})
-		if err != nil || res == nil || res.StatusCode != 200 {
-			if res != nil && res.StatusCode != 200 {
-				err = fmt.Errorf("non-200 statuscode received from twitch %v", res)
-			} else if err == nil {
-				err = fmt.Errorf("non-200 statuscode received from twitch")
-			}
-			d.P("Failed to GET the auth token, url, res, err", u, res, err)
-			return err
-		}
-		tokens := &TokenStruct{}
-		err = json.NewDecoder(res.Body).Decode(tokens)
-		res.Body.Close()
-		if err != nil {
-			d.P("Failed to decode twitch response %v", err)
-			return err
-		}
-		d.DF(1, "Updated OAuth Tokens")
-		c.cfg.RefreshToken = tokens.RefreshToken
-		c.cfg.AccessToken = tokens.AccessToken
-		config.ReadTokensFile(c.cfg, true)
-	}
-	d.DF(1, "Response %v", res)
-	return nil
-}
\ No newline at end of file
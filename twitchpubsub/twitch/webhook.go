@@ -0,0 +1,219 @@
+package twitch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/queue"
+	"golang.org/x/net/context"
+)
+
+const (
+	// twitch eventsub webhooks
+	// https://dev.twitch.tv/docs/eventsub/handling-webhook-events
+	headerMessageID        = "Twitch-Eventsub-Message-Id"
+	headerMessageType      = "Twitch-Eventsub-Message-Type"
+	headerMessageSignature = "Twitch-Eventsub-Message-Signature"
+	headerMessageTimestamp = "Twitch-Eventsub-Message-Timestamp"
+
+	msgTypeVerification    = "webhook_callback_verification"
+	msgTypeWebhookNotify   = "notification"
+	msgTypeWebhookRevoke   = "revocation"
+	webhookMaxAge          = 10 * time.Minute
+	webhookMaxBody         = 64 * 1024
+	webhookShutdownTimeout = 5 * time.Second
+)
+
+type Webhook struct {
+	cfg     *config.Holder
+	addr    string
+	apibase string
+	auth    *twitchauth.Manager
+	client  *http.Client
+	secret  string
+	seen    *seenIDs
+	q       *queue.Queue
+}
+
+type webhookPayload struct {
+	Challenge    string `json:"challenge"`
+	Subscription struct {
+		ID     string `json:"id"`
+		Type   string `json:"type"`
+		Status string `json:"status"`
+	} `json:"subscription"`
+	Event json.RawMessage `json:"event"`
+}
+
+// NewWebhook creates the webhook server, the listen address, the secret, the
+// helix url and the tls settings are read once here
+func NewWebhook(h *config.Holder, q *queue.Queue, auth *twitchauth.Manager) *Webhook {
+	cfg := h.Get()
+	client, _ := clients(h)
+	w := &Webhook{
+		cfg:     h,
+		addr:    cfg.TwitchPubSub.WebhookAddr,
+		apibase: helixUri,
+		auth:    auth,
+		client:  client,
+		secret:  cfg.TwitchPubSub.WebhookSecret,
+		// twitch rejects messages older than webhookMaxAge, so remembering
+		// the ids for that long is enough to catch every retry
+		seen: newSeenIDs(webhookMaxAge),
+		q:    q,
+	}
+	if cfg.TwitchPubSub.HelixURL != "" {
+		w.apibase = cfg.TwitchPubSub.HelixURL
+	}
+	return w
+}
+
+func (w *Webhook) run() {
+	srv := &http.Server{
+		Addr:    w.addr,
+		Handler: w,
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		d.DF(1, "interrupted")
+		ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	// twitch verifies the callback while the subscription is being created
+	// so the server has to be up by then
+	if w.cfg.Get().TwitchPubSub.WebhookCallbackURL != "" {
+		go func() {
+			if err := w.subscribeAll(); err != nil {
+				d.P("Failed to create the webhook subscriptions", err)
+			}
+		}()
+	}
+
+	d.DF(1, "listening on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		d.F("webhook server failed: %v", err)
+	}
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, webhookMaxBody))
+	if err != nil {
+		http.Error(rw, "could not read body", http.StatusBadRequest)
+		return
+	}
+
+	id := r.Header.Get(headerMessageID)
+	if err := w.verify(id, r.Header.Get(headerMessageTimestamp), r.Header.Get(headerMessageSignature), body); err != nil {
+		d.P("Rejected webhook message", id, err)
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	p := &webhookPayload{}
+	if err := json.Unmarshal(body, p); err != nil {
+		http.Error(rw, "could not decode body", http.StatusBadRequest)
+		return
+	}
+
+	switch typ := r.Header.Get(headerMessageType); typ {
+	case msgTypeVerification:
+		d.DF(1, "verified subscription %s", p.Subscription.Type)
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte(p.Challenge))
+	case msgTypeWebhookRevoke:
+		d.P("subscription revoked", p.Subscription.Type, p.Subscription.Status)
+		rw.WriteHeader(http.StatusNoContent)
+	case msgTypeWebhookNotify:
+		if w.seen.Seen(id) {
+			d.DF(1, "duplicate message %s", id)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		url := eventSubURL(&w.cfg.Get().TwitchScrape, p.Subscription.Type)
+		if url == "" {
+			d.DF(1, "no url for %s, dropping %s", p.Subscription.Type, id)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		err := relay(w.q, url, p.Subscription.Type, r.Header.Get(headerMessageTimestamp), p.Event)
+		if err != nil {
+			// forget the message so that the retry from twitch gets relayed
+			w.seen.Forget(id)
+			http.Error(rw, "could not relay event", http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		d.DF(1, "Unsupported message type: %s", typ)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify checks the signature and the age of the message
+// https://dev.twitch.tv/docs/eventsub/handling-webhook-events#verifying-the-event-message
+func (w *Webhook) verify(id, timestamp, signature string, body []byte) error {
+	if id == "" || timestamp == "" || signature == "" {
+		return fmt.Errorf("missing eventsub headers")
+	}
+
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write([]byte(id))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return fmt.Errorf("bad timestamp %q: %v", timestamp, err)
+	}
+	if age := time.Since(ts); age > webhookMaxAge || age < -webhookMaxAge {
+		return fmt.Errorf("stale message, timestamp %s", timestamp)
+	}
+	return nil
+}
+
+func (w *Webhook) subscribeAll() error {
+	// webhook subscriptions can not be created with user tokens
+	token, err := w.auth.AppToken()
+	if err != nil {
+		return err
+	}
+
+	cfg := w.cfg.Get()
+	transport := map[string]string{
+		"method":   "webhook",
+		"callback": cfg.TwitchPubSub.WebhookCallbackURL,
+		"secret":   w.secret,
+	}
+	for _, typ := range eventSubTypes(&cfg.TwitchScrape) {
+		err := createSubscription(w.client, w.apibase, cfg.TwitchScrape.ClientID, token, cfg.TwitchScrape.ChannelID, typ, transport)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package twitch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/twitchpubsub/queue"
+)
+
+const testWebhookSecret = "0123456789abcdef"
+
+func newTestWebhook(t *testing.T) (*Webhook, string) {
+	cfg := &config.AppConfig{}
+	cfg.TwitchScrape.SubURL = "http://website/sub"
+	cfg.TwitchPubSub.WebhookSecret = testWebhookSecret
+	h := &config.Holder{}
+	h.Set(cfg)
+
+	dir := t.TempDir()
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWebhook(h, q, nil), dir
+}
+
+func sign(secret, id, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + timestamp + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends body to w the way twitch does, signed with secret
+func post(w *Webhook, secret, id, typ string, ts time.Time, body string) *httptest.ResponseRecorder {
+	timestamp := ts.UTC().Format(time.RFC3339Nano)
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set(headerMessageID, id)
+	r.Header.Set(headerMessageType, typ)
+	r.Header.Set(headerMessageTimestamp, timestamp)
+	r.Header.Set(headerMessageSignature, sign(secret, id, timestamp, body))
+	rw := httptest.NewRecorder()
+	w.ServeHTTP(rw, r)
+	return rw
+}
+
+const testNotification = `{"subscription":{"type":"channel.subscribe"},"event":{"user_id":"42","user_login":"someone","tier":"1000"}}`
+
+func TestWebhookChallenge(t *testing.T) {
+	w, _ := newTestWebhook(t)
+	body := `{"challenge":"pogchamp","subscription":{"type":"channel.subscribe","status":"webhook_callback_verification_pending"}}`
+	rw := post(w, testWebhookSecret, "1", msgTypeVerification, time.Now(), body)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rw.Code)
+	}
+	if got, _ := ioutil.ReadAll(rw.Body); string(got) != "pogchamp" {
+		t.Fatalf("body = %q, want the challenge", got)
+	}
+}
+
+func TestWebhookRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		ts     time.Time
+	}{
+		{"bad signature", "not the secret", time.Now()},
+		{"stale timestamp", testWebhookSecret, time.Now().Add(-webhookMaxAge - time.Minute)},
+		{"future timestamp", testWebhookSecret, time.Now().Add(webhookMaxAge + time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, dir := newTestWebhook(t)
+			rw := post(w, tt.secret, "1", msgTypeWebhookNotify, tt.ts, testNotification)
+			if rw.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403", rw.Code)
+			}
+			if events := queued(t, dir); len(events) != 0 {
+				t.Fatalf("queued %d events, want none", len(events))
+			}
+		})
+	}
+}
+
+func TestWebhookMissingHeaders(t *testing.T) {
+	w, _ := newTestWebhook(t)
+	r := httptest.NewRequest("POST", "/", strings.NewReader(testNotification))
+	rw := httptest.NewRecorder()
+	w.ServeHTTP(rw, r)
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rw.Code)
+	}
+}
+
+func TestWebhookDuplicate(t *testing.T) {
+	w, dir := newTestWebhook(t)
+	for i := 0; i < 2; i++ {
+		rw := post(w, testWebhookSecret, "same-id", msgTypeWebhookNotify, time.Now(), testNotification)
+		if rw.Code != http.StatusNoContent {
+			t.Fatalf("delivery %d: status = %d, want 204", i, rw.Code)
+		}
+	}
+	events := queued(t, dir)
+	if len(events) != 1 {
+		t.Fatalf("queued %d events, want 1", len(events))
+	}
+	if events[0].Key != "42" || events[0].URL != "http://website/sub" {
+		t.Fatalf("queued %+v", events[0])
+	}
+
+	post(w, testWebhookSecret, "other-id", msgTypeWebhookNotify, time.Now(), testNotification)
+	if events := queued(t, dir); len(events) != 2 {
+		t.Fatalf("queued %d events after a new id, want 2", len(events))
+	}
+}
+
+func TestWebhookSecretNeedsRestart(t *testing.T) {
+	w, _ := newTestWebhook(t)
+	// the subscriptions were created with the old secret, twitch keeps
+	// signing with it until they are created again
+	cfg := *w.cfg.Get()
+	cfg.TwitchPubSub.WebhookSecret = "reloaded secret"
+	w.cfg.Set(&cfg)
+
+	if rw := post(w, testWebhookSecret, "1", msgTypeWebhookNotify, time.Now(), testNotification); rw.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", rw.Code)
+	}
+}
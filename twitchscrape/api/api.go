@@ -22,43 +22,73 @@ package api
 import (
 	"bytes"
 	_ "crypto/sha512"
-	"crypto/tls"
 	"encoding/json"
-	"io"
-	"io/ioutil"
-	"net/http"
+	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/destinygg/twitch-subscriber-sync/internal/config"
 	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/dggapi"
+	"github.com/destinygg/twitch-subscriber-sync/internal/dlq"
+	"github.com/destinygg/twitch-subscriber-sync/twitchscrape/snapshot"
 	"github.com/destinygg/twitch-subscriber-sync/twitchscrape/twitch"
 	"golang.org/x/net/context"
 )
 
 type Api struct {
-	cfg *config.AppConfig
+	cfg *config.Holder
+	// DryRun prints the diff instead of sending it to the website and
+	// AllowMassExpiry disables the mass expiry guard, set them before running
+	DryRun          bool
+	AllowMassExpiry bool
+	// reloaded is signaled after the config was reloaded
+	reloaded chan struct{}
 
 	mu sync.Mutex
 	// subs are keyed by ids that are alphanumeric but not necessarily only digits
+	// the value is the tier of the sub (1-3), 0 means the sub expired
 	subs       map[string]int
-	client     http.Client
+	client     *dggapi.Client
+	store      snapshot.Store
+	dlq        *dlq.Store
+	// loaded is set once the snapshot was read from the store
+	loaded     bool
+	// releaseExpiry is set to 1 by the admin endpoint to let held back
+	// expiries through on the next sync
+	releaseExpiry int32
+}
+
+// SubInfo is what gets POSTed to ModSubURL for every changed sub, a Tier of 0
+// means the sub expired
+type SubInfo struct {
+	Tier       int    `json:"tier"`
+	IsGift     bool   `json:"is_gift,omitempty"`
+	GifterID   string `json:"gifter_id,omitempty"`
+	GifterName string `json:"gifter_login,omitempty"`
+	PlanName   string `json:"plan_name,omitempty"`
 }
 
 func Init(ctx context.Context) context.Context {
+	cfg := config.HolderFromContext(ctx)
+	// the snapshot store is chosen once, changing it needs a restart
+	store, err := snapshot.New(cfg.Get(), cfg.Name())
+	if err != nil {
+		d.F("Could not create the snapshot store: %v", err)
+	}
+
 	api := &Api{
-		cfg:        config.FromContext(ctx),
+		cfg:        cfg,
+		reloaded:   make(chan struct{}, 1),
 		subs:       map[string]int{},
-		client: http.Client{
-			Timeout: 5 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig:       &tls.Config{},
-				ResponseHeaderTimeout: 5 * time.Second,
-			},
-		},
+		store:      store,
+		dlq:        dlq.FromContext(ctx),
+		client:     dggapi.New(cfg),
 	}
 
-	api.run(twitch.FromContext(ctx))
 	return context.WithValue(ctx, "dggapi", api)
 }
 
@@ -67,41 +97,15 @@ func FromContext(ctx context.Context) *Api {
 	return api
 }
 
-func (a *Api) call(method, url string, body io.Reader) ([]byte, error) {
-	u := url + "?privatekey=" + a.cfg.Website.PrivateAPIKey
-	req, err := http.NewRequest(method, u, body)
-	if err != nil {
-		d.PF(2, "Could not create request: %#v", err)
-		return nil, err
-	}
-
-	res, err := a.client.Do(req)
-	if res == nil || res.Body == nil {
-		return nil, nil
-	}
-	defer res.Body.Close()
-
-	if err != nil || res.StatusCode < 200 || res.StatusCode >= 300 {
-		data, _ := ioutil.ReadAll(res.Body)
-		d.PF(2, "Request failed: %#v, body was \n%v", err, string(data))
-		return nil, err
-	}
-
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		d.PF(2, "Could not read body: %#v", err)
-		return nil, err
-	}
-
-	return data, nil
-}
-
 func (a *Api) getSubsLocked() error {
+	// tiers is optional, subs without a known tier keep the tier we last saw
+	// or default to tier 1
 	userids := struct {
-		Authids []string `json:"authids"`
+		Authids []string       `json:"authids"`
+		Tiers   map[string]int `json:"tiers"`
 	}{}
 
-	data, err := a.call("GET", a.cfg.TwitchScrape.GetSubURL, nil)
+	data, err := a.client.Get(a.cfg.Get().TwitchScrape.GetSubURL)
 	if err != nil {
 		return err
 	}
@@ -112,81 +116,208 @@ func (a *Api) getSubsLocked() error {
 	}
 
 	for _, id := range userids.Authids {
-		a.subs[id] = 1
+		if tier, ok := userids.Tiers[id]; ok && tier > 0 {
+			a.subs[id] = tier
+		} else if a.subs[id] == 0 {
+			a.subs[id] = 1
+		}
 	}
 	return nil
 }
 
 // separate url parameter so that we can differentiate between resubs and
 // fresh subs
-func (a Api) syncSubs(subs map[string]int, url string) error {
+// a payload the website refused is dead lettered and counts as sent, sending
+// it again would hold back every later change, other errors are returned so
+// that the next sync sends it again
+func (a *Api) syncSubs(subs map[string]SubInfo, url string) error {
 	buf := &bytes.Buffer{}
 	json.NewEncoder(buf).Encode(subs)
-	_, err := a.call("POST", url, buf)
+	body := buf.Bytes()
+	_, err := a.client.Post(url, body)
+	if err == nil || dggapi.Retryable(err) || a.dlq == nil {
+		return err
+	}
+	if derr := a.dlq.Add(dlq.NewEntry(url, body, err, 1)); derr != nil {
+		d.P("Could not dead letter the payload: ", derr)
+		return err
+	}
+	d.P("ALERT: the website refused the sync, it was dead lettered: ", err)
+	return nil
+}
+
+// SendToApi posts a payload to the given website endpoint
+func (a *Api) SendToApi(url string, body []byte) error {
+	_, err := a.client.Post(url, body)
 	return err
 }
 
-func (a *Api) run(tw *twitch.Twitch) {
-	t := time.NewTicker(time.Duration(a.cfg.PollMinutes) * time.Minute)
+// Reloaded tells Run that the config changed, it never blocks
+func (a *Api) Reloaded() {
+	select {
+	case a.reloaded <- struct{}{}:
+	default:
+	}
+}
 
+// Run syncs the subs every PollMinutes, it never returns
+func (a *Api) Run(tw *twitch.Twitch) {
+	poll := a.cfg.Get().PollMinutes
+	t := time.NewTicker(time.Duration(poll) * time.Minute)
+	// the admin endpoint keeps listening on the address it started with
+	if addr := a.cfg.Get().TwitchScrape.AdminAddr; addr != "" {
+		go a.serveAdmin(addr)
+	}
+
+	var failures int
 	for {
-		err := a.syncFromTwitch(tw)
+		_, err := a.syncFromTwitch(tw)
 		// retry on error
 		if err != nil {
-			d.P("syncFromTwitch failed, retrying: ", err)
-			time.Sleep(30 * time.Second)
+			failures++
+			dur := retryDelay(err, failures)
+			d.P("syncFromTwitch failed, retrying in: ", dur, a.cfg.Get().TwitchScrape.Channel, err)
+			time.Sleep(dur)
 			continue
 		}
+		failures = 0
+
+		for waiting := true; waiting; {
+			select {
+			case <-t.C:
+				waiting = false
+			case <-a.reloaded:
+				if n := a.cfg.Get().PollMinutes; n != poll {
+					d.P("Poll interval changed to minutes: ", n)
+					poll = n
+					t.Stop()
+					t = time.NewTicker(time.Duration(poll) * time.Minute)
+				}
+			}
+		}
+	}
+}
 
-		_ = <-t.C
+// retryDelay decides how long to wait before retrying based on the kind of
+// error, failures is the number of consecutive failed syncs
+func retryDelay(err error, failures int) time.Duration {
+	var terr *twitch.Error
+	switch {
+	case errors.As(err, &terr) && terr.Kind == twitch.ErrRateLimited:
+		if dur := time.Until(terr.Reset); dur > 0 {
+			return dur + time.Second
+		}
+		return 30 * time.Second
+	case errors.Is(err, twitch.ErrAuthExpired):
+		// the token was refreshed already, retry right away
+		return time.Second
+	case errors.Is(err, twitch.ErrRefreshRevoked):
+		// needs a new authorization, no point in hammering twitch
+		d.P("ALERT: the twitch refresh token was revoked, reauthorization is needed")
+		return 10 * time.Minute
+	case errors.Is(err, twitch.ErrServer), errors.Is(err, twitch.ErrNetwork):
+		// back off exponentially from 5 seconds up to 5 minutes
+		if failures > 7 {
+			failures = 7
+		}
+		dur := time.Duration(5<<uint(failures-1)) * time.Second
+		if dur > 5*time.Minute {
+			dur = 5 * time.Minute
+		}
+		return dur
+	default:
+		return 30 * time.Second
 	}
 }
 
-func (a *Api) syncFromTwitch(tw *twitch.Twitch) error {
+// ErrExpiryHeld is returned by SyncOnce when the mass expiry guard held back
+// expiries, the rest of the diff was synced
+var ErrExpiryHeld = errors.New("expiries were held back by the mass expiry guard")
+
+// SyncOnce runs a single sync
+func (a *Api) SyncOnce(tw *twitch.Twitch) error {
+	diff, err := a.syncFromTwitch(tw)
+	if err != nil {
+		return err
+	}
+	if len(diff.Held) > 0 {
+		return fmt.Errorf("%w: %d subs", ErrExpiryHeld, len(diff.Held))
+	}
+	return nil
+}
+
+// Diff returns the difference between the subs known to the website and the
+// subs on twitch without sending or recording it
+func (a *Api) Diff(tw *twitch.Twitch) (*Diff, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	users, err := a.fetchLocked(tw)
+	if err != nil {
+		return nil, err
+	}
+	diff := a.diffLocked(users)
+	a.guardLocked(diff)
+	return diff, nil
+}
+
+// fetchLocked loads the snapshot on first use, updates the known subs from
+// the website and returns the subs on twitch
+func (a *Api) fetchLocked(tw *twitch.Twitch) ([]twitch.User, error) {
+	if !a.loaded {
+		subs, err := a.store.Load()
+		if err != nil {
+			d.P("Could not load the snapshot: ", err)
+			return nil, err
+		}
+		for id, tier := range subs {
+			a.subs[id] = tier
+		}
+		a.loaded = true
+	}
+
 	err := a.getSubsLocked()
 	if err != nil {
 		d.P("Could not get subs: ", err)
-		return err
+		return nil, err
 	}
 
-	users, err := tw.GetSubs()
+	return tw.GetSubs()
+}
+
+func (a *Api) syncFromTwitch(tw *twitch.Twitch) (*Diff, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	users, err := a.fetchLocked(tw)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	diff := make(map[string]int)
-	visited := make(map[string]struct{}, len(users))
+	diff := a.diffLocked(users)
+	a.guardLocked(diff)
 
-	for _, u := range users {
-		visited[u.ID] = struct{}{}
-		wassub, ok := a.subs[u.ID]
-		if wassub != 1 && ok { // was not a sub before, but is now
-			a.subs[u.ID] = 1
-			diff[u.ID] = 1
-		} else if !ok { // was not found at all, but could have registered since
-			diff[u.ID] = 1
-		}
+	// report the difference from the known d.gg subs always
+	d.DF(1, "Found %v subs, syncing: %v, number of expired/notfound subs: %v", len(users), len(diff.Subs), len(diff.Expired))
+	if a.DryRun {
+		diff.WriteReport(os.Stdout)
+		return diff, nil
 	}
 
-	// now check for expired subs, expired var is purely for logging reasons
-	var expired int
-	for id, wassub := range a.subs {
-		if _, ok := visited[id]; ok { // already seen, has to be a sub
-			continue
-		}
-		if wassub == 1 { // was a sub, but is no longer
-			a.subs[id] = 0
-			diff[id] = 0
-			expired++
-		}
+	// a.subs only changes once the website has the diff, so that the next
+	// sync sends a failed one again
+	err = a.syncSubs(diff.Subs, a.cfg.Get().TwitchScrape.ModSubURL)
+	if err != nil {
+		return nil, err
+	}
+	a.applyLocked(diff)
+	if diff.released {
+		atomic.StoreInt32(&a.releaseExpiry, 0)
 	}
 
-	// report the difference from the known d.gg subs always
-	d.DF(1, "Found %v subs, syncing: %v, number of expired/notfound subs: %v", len(users), len(diff), expired)
-	err = a.syncSubs(diff, a.cfg.TwitchScrape.ModSubURL)
-
-	return err
+	// a failed save is not fatal, the next sync will just send a bigger diff
+	if err := a.store.Save(a.subs); err != nil {
+		d.P("Could not save the snapshot: ", err)
+	}
+	return diff, nil
 }
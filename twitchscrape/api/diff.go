@@ -0,0 +1,149 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/destinygg/twitch-subscriber-sync/twitchscrape/twitch"
+)
+
+// Diff is the difference between the subs known to the website and the subs
+// on twitch, Subs is what gets POSTed to ModSubURL, the rest is for reporting
+type Diff struct {
+	Subs map[string]SubInfo `json:"-"`
+	// Added were known but not subbed before
+	Added []DiffEntry `json:"added"`
+	// Changed are subs whose tier changed
+	Changed []DiffEntry `json:"changed"`
+	// Expired were subbed but are no longer
+	Expired []DiffEntry `json:"expired"`
+	// Unknown were not found at all, but could have registered since
+	Unknown []DiffEntry `json:"unknown"`
+	// Held would have expired but were held back by the mass expiry guard
+	Held []DiffEntry `json:"held"`
+	// released is set if the expiries got past the guard by a release
+	released bool
+}
+
+type DiffEntry struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Tier    int    `json:"tier"`
+	OldTier int    `json:"oldtier"`
+}
+
+// diffLocked compares a.subs to users without modifying a.subs
+func (a *Api) diffLocked(users []twitch.User) *Diff {
+	diff := &Diff{
+		Subs:    make(map[string]SubInfo),
+		Added:   []DiffEntry{},
+		Changed: []DiffEntry{},
+		Expired: []DiffEntry{},
+		Unknown: []DiffEntry{},
+		Held:    []DiffEntry{},
+	}
+	visited := make(map[string]struct{}, len(users))
+
+	for _, u := range users {
+		visited[u.ID] = struct{}{}
+		info := SubInfo{
+			Tier:       u.Tier,
+			IsGift:     u.IsGift,
+			GifterID:   u.GifterID,
+			GifterName: u.GifterName,
+			PlanName:   u.PlanName,
+		}
+		e := DiffEntry{ID: u.ID, Name: u.Name, Tier: u.Tier}
+
+		wastier, ok := a.subs[u.ID]
+		e.OldTier = wastier
+		if !ok {
+			diff.Subs[u.ID] = info
+			diff.Unknown = append(diff.Unknown, e)
+		} else if wastier == 0 {
+			diff.Subs[u.ID] = info
+			diff.Added = append(diff.Added, e)
+		} else if wastier != u.Tier {
+			diff.Subs[u.ID] = info
+			diff.Changed = append(diff.Changed, e)
+		}
+	}
+
+	for id, wastier := range a.subs {
+		if _, ok := visited[id]; ok { // already seen, has to be a sub
+			continue
+		}
+		if wastier > 0 { // was a sub, but is no longer
+			diff.Subs[id] = SubInfo{}
+			diff.Expired = append(diff.Expired, DiffEntry{ID: id, OldTier: wastier})
+		}
+	}
+
+	diff.sort()
+	return diff
+}
+
+// applyLocked records the new state of the subs in a.subs, unknown users are
+// not recorded, the website tells us about them once they are registered
+func (a *Api) applyLocked(diff *Diff) {
+	for _, e := range diff.Added {
+		a.subs[e.ID] = e.Tier
+	}
+	for _, e := range diff.Changed {
+		a.subs[e.ID] = e.Tier
+	}
+	for _, e := range diff.Expired {
+		a.subs[e.ID] = 0
+	}
+}
+
+func (diff *Diff) sort() {
+	for _, l := range [][]DiffEntry{diff.Added, diff.Changed, diff.Expired, diff.Unknown} {
+		l := l
+		sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	}
+}
+
+// WriteReport writes a human readable summary followed by the json encoded diff
+func (diff *Diff) WriteReport(w io.Writer) error {
+	sections := []struct {
+		title   string
+		entries []DiffEntry
+	}{
+		{"would be added", diff.Added},
+		{"would change tier", diff.Changed},
+		{"would be expired", diff.Expired},
+		{"unknown to the website", diff.Unknown},
+		{"held back by the mass expiry guard", diff.Held},
+	}
+
+	for _, s := range sections {
+		fmt.Fprintf(w, "%d %s\n", len(s.entries), s.title)
+		for _, e := range s.entries {
+			fmt.Fprintf(w, "  %s %s tier %d -> %d\n", e.ID, e.Name, e.OldTier, e.Tier)
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(diff)
+}
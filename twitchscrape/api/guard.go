@@ -0,0 +1,111 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package api
+
+import (
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+)
+
+// guardLocked holds back the expired part of the diff if there are more of
+// them than configured, a truncated list from twitch would otherwise expire
+// every sub we know about
+func (a *Api) guardLocked(diff *Diff) {
+	if len(diff.Expired) == 0 || a.AllowMassExpiry {
+		return
+	}
+
+	limit := a.expiryLimitLocked()
+	if limit < 0 || len(diff.Expired) <= limit {
+		return
+	}
+
+	// the release is only used up once the diff reached the website, see
+	// syncFromTwitch
+	if atomic.LoadInt32(&a.releaseExpiry) == 1 {
+		d.P("Mass expiry was released, expiring subs: ", len(diff.Expired))
+		diff.released = true
+		return
+	}
+
+	d.PF(1, "ALERT: holding back the expiry of %v subs, the limit is %v, release it with -allow-mass-expiry or the admin endpoint", len(diff.Expired), limit)
+	for _, e := range diff.Expired {
+		delete(diff.Subs, e.ID)
+	}
+	diff.Held = diff.Expired
+	diff.Expired = []DiffEntry{}
+}
+
+// expiryLimitLocked returns the lower of the configured limits, -1 if none are
+// configured
+func (a *Api) expiryLimitLocked() int {
+	cfg := &a.cfg.Get().TwitchScrape
+	limit := -1
+	if n := cfg.MaxExpire; n > 0 {
+		limit = n
+	}
+	if p := cfg.MaxExpirePercent; p > 0 {
+		var active int
+		for _, tier := range a.subs {
+			if tier > 0 {
+				active++
+			}
+		}
+		// rounded up and at least 1, so that a single expiry on a small
+		// channel is never held back
+		n := int(math.Ceil(float64(active) * p / 100))
+		if n < 1 {
+			n = 1
+		}
+		if limit < 0 || n < limit {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// serveAdmin serves the endpoint that releases held back expiries on the next
+// sync, requests have to carry the admin password as a bearer token
+func (a *Api) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/release-expiry", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		pass := a.cfg.Get().TwitchScrape.AdminPassword
+		if pass == "" || subtle.ConstantTimeCompare([]byte(token), []byte(pass)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		atomic.StoreInt32(&a.releaseExpiry, 1)
+		d.P("Mass expiry release requested from ", r.RemoteAddr)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	d.DF(1, "admin endpoint listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		d.P("Admin endpoint failed: ", err)
+	}
+}
@@ -0,0 +1,124 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+)
+
+// newTestApi returns an api that knows about active subs and 10 expired ones
+func newTestApi(ts config.TwitchScrape, active int) *Api {
+	cfg := &config.AppConfig{TwitchScrape: ts}
+	h := &config.Holder{}
+	h.Set(cfg)
+	a := &Api{cfg: h, subs: map[string]int{}}
+	for i := 0; i < active; i++ {
+		a.subs[fmt.Sprintf("active%d", i)] = 1
+	}
+	for i := 0; i < 10; i++ {
+		a.subs[fmt.Sprintf("expired%d", i)] = 0
+	}
+	return a
+}
+
+func TestExpiryLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		percent float64
+		active  int
+		want    int
+	}{
+		{"no limit", 0, 0, 100, -1},
+		{"max", 10, 0, 100, 10},
+		{"percent", 0, 10, 200, 20},
+		{"percent rounded up", 0, 2.5, 100, 3},
+		{"percent at least one", 0, 10, 5, 1},
+		{"percent without subs", 0, 10, 0, 1},
+		{"lower of both max", 5, 50, 100, 5},
+		{"lower of both percent", 50, 10, 100, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApi(config.TwitchScrape{MaxExpire: tt.max, MaxExpirePercent: tt.percent}, tt.active)
+			if got := a.expiryLimitLocked(); got != tt.want {
+				t.Fatalf("limit = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func expiringDiff(n int) *Diff {
+	diff := &Diff{Subs: map[string]SubInfo{"new": {Tier: 1}}, Expired: []DiffEntry{}, Held: []DiffEntry{}}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("active%d", i)
+		diff.Subs[id] = SubInfo{}
+		diff.Expired = append(diff.Expired, DiffEntry{ID: id, OldTier: 1})
+	}
+	return diff
+}
+
+func TestGuard(t *testing.T) {
+	tests := []struct {
+		name    string
+		expired int
+		allow   bool
+		release bool
+		held    bool
+	}{
+		{"below the limit", 5, false, false, false},
+		{"at the limit", 10, false, false, false},
+		{"above the limit", 11, false, false, true},
+		{"allowed", 11, true, false, false},
+		{"released", 11, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApi(config.TwitchScrape{MaxExpire: 10}, 100)
+			a.AllowMassExpiry = tt.allow
+			if tt.release {
+				a.releaseExpiry = 1
+			}
+			diff := expiringDiff(tt.expired)
+			a.guardLocked(diff)
+
+			if tt.held {
+				if len(diff.Held) != tt.expired || len(diff.Expired) != 0 {
+					t.Fatalf("held %d and expired %d, want all %d held", len(diff.Held), len(diff.Expired), tt.expired)
+				}
+				if len(diff.Subs) != 1 {
+					t.Fatalf("posting %d subs, want only the new one", len(diff.Subs))
+				}
+			} else {
+				if len(diff.Held) != 0 || len(diff.Expired) != tt.expired {
+					t.Fatalf("held %d and expired %d, want none held", len(diff.Held), len(diff.Expired))
+				}
+				if len(diff.Subs) != tt.expired+1 {
+					t.Fatalf("posting %d subs, want %d", len(diff.Subs), tt.expired+1)
+				}
+			}
+			// only a sync that reached the website uses up the release
+			if tt.release && (a.releaseExpiry != 1 || !diff.released) {
+				t.Fatalf("release = %d, released = %v", a.releaseExpiry, diff.released)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/dggapi"
+	"github.com/destinygg/twitch-subscriber-sync/internal/dlq"
+)
+
+func TestSyncSubsDeadLetter(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantErr  bool
+		dlqCount int
+	}{
+		{"accepted", http.StatusOK, false, 0},
+		{"refused", http.StatusBadRequest, false, 1},
+		{"server error", http.StatusInternalServerError, true, 0},
+		{"rate limited", http.StatusTooManyRequests, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			store, err := dlq.Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &config.Holder{}
+			h.Set(&config.AppConfig{})
+			a := &Api{cfg: h, client: dggapi.New(h), dlq: store}
+
+			err = a.syncSubs(map[string]SubInfo{"42": {Tier: 1}}, srv.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			entries, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.dlqCount {
+				t.Fatalf("dead lettered %d payloads, want %d", len(entries), tt.dlqCount)
+			}
+		})
+	}
+}
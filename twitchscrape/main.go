@@ -20,19 +20,286 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
+
 	"github.com/destinygg/twitch-subscriber-sync/internal/config"
 	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/dlq"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
 	"github.com/destinygg/twitch-subscriber-sync/twitchscrape/api"
 	"github.com/destinygg/twitch-subscriber-sync/twitchscrape/twitch"
 	"golang.org/x/net/context"
 )
 
+// exit codes of the subcommands
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+	// sync-once synced but held back expiries, see -allow-mass-expiry
+	exitHeld = 3
+)
+
+var (
+	channelFlag = flag.String("channel", "", `the channel block the command runs for, required when several are configured`)
+	dryRun      = flag.Bool("dry-run", false, `compute the diff but print it instead of sending it to the website`)
+	allowMass   = flag.Bool("allow-mass-expiry", false, `do not hold back expiring more subs than maxexpire/maxexpirepercent allow`)
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: %s [flags] [command]
+
+commands:
+  (none)         run the sync of every channel every pollminutes
+  sync-once      run a single sync and exit, exits with 3 if expiries were
+                 held back
+  list-subs      print the subs on twitch, -format json|csv
+  diff           print the difference between the website and twitch
+  refresh-token  refresh the twitch tokens and save them
+  authorize      get the initial twitch tokens, -redirect url or -device
+  check-config   validate the config and exit
+  dlq            list|show <id>|replay --id <id>|--all the undelivered payloads
+
+flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
 	time.Local = time.UTC
+	flag.Usage = usage
 	ctx := context.Background()
 	ctx = config.Init(ctx)
+
+	err := config.FromContext(ctx).Validate(config.AppTwitchScrape)
+	if flag.Arg(0) == "check-config" {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFailed)
+		}
+		fmt.Println("config ok")
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFailed)
+	}
+	if err := config.ReadTokens(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFailed)
+	}
+
 	ctx = d.Init(ctx)
+	ctx = dlq.Init(ctx)
+
+	// the payloads carry their url, so they can be replayed without a channel
+	if flag.Arg(0) == "dlq" {
+		os.Exit(deadLetters(api.Init(ctx), flag.Args()))
+	}
+
+	holders, err := channelHolders(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	if flag.NArg() == 0 {
+		run(ctx, holders)
+		os.Exit(exitOK)
+	}
+	if len(holders) > 1 {
+		fmt.Fprintln(os.Stderr, "several channels are configured, select one with -channel")
+		os.Exit(exitUsage)
+	}
+	ctx = config.WithHolder(ctx, holders[0])
+
+	// bootstrapping the tokens needs none of the machinery that uses them
+	if flag.Arg(0) == "authorize" {
+		os.Exit(authorize(ctx, flag.Args()))
+	}
+
+	os.Exit(runCommand(setup(ctx), flag.Args()))
+}
+
+// channelHolders returns the config of every channel selected by -channel,
+// the whole config if there are no channel blocks
+func channelHolders(ctx context.Context) ([]*config.Holder, error) {
+	root := config.HolderFromContext(ctx)
+	names := root.Get().ChannelNames()
+	if len(names) == 0 {
+		if *channelFlag != "" {
+			return nil, fmt.Errorf("-channel given but no channels are configured")
+		}
+		return []*config.Holder{root}, nil
+	}
+
+	if *channelFlag != "" {
+		h := root.Channel(*channelFlag)
+		if h == nil {
+			return nil, fmt.Errorf("unknown channel %q", *channelFlag)
+		}
+		return []*config.Holder{h}, nil
+	}
+
+	holders := make([]*config.Holder, 0, len(names))
+	for _, name := range names {
+		holders = append(holders, root.Channel(name))
+	}
+	return holders, nil
+}
+
+// setup creates the components of the channel whose config is in ctx
+func setup(ctx context.Context) context.Context {
+	ctx = twitchauth.Init(ctx)
 	ctx = twitch.Init(ctx)
 	ctx = api.Init(ctx)
-}
\ No newline at end of file
+	a := api.FromContext(ctx)
+	a.DryRun = *dryRun
+	a.AllowMassExpiry = *allowMass
+	return ctx
+}
+
+// run syncs every channel on its own schedule, a channel failing only delays
+// its own syncs, it never returns
+func run(ctx context.Context, holders []*config.Holder) {
+	apis := make([]*api.Api, 0, len(holders))
+	for _, h := range holders {
+		cctx := setup(config.WithHolder(ctx, h))
+		a := api.FromContext(cctx)
+		apis = append(apis, a)
+		go a.Run(twitch.FromContext(cctx))
+	}
+	watchReload(ctx, apis)
+}
+
+func runCommand(ctx context.Context, args []string) int {
+	tw := twitch.FromContext(ctx)
+	a := api.FromContext(ctx)
+
+	switch args[0] {
+	case "sync-once":
+		err := a.SyncOnce(tw)
+		if errors.Is(err, api.ErrExpiryHeld) {
+			fmt.Fprintln(os.Stderr, err)
+			return exitHeld
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sync failed:", err)
+			return exitFailed
+		}
+	case "list-subs":
+		fs := flag.NewFlagSet("list-subs", flag.ContinueOnError)
+		format := fs.String("format", "json", `output format, "json" or "csv"`)
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		users, err := tw.GetSubs()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not get the subs:", err)
+			return exitFailed
+		}
+		if err := writeSubs(users, *format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	case "diff":
+		diff, err := a.Diff(tw)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not compute the diff:", err)
+			return exitFailed
+		}
+		diff.WriteReport(os.Stdout)
+	case "refresh-token":
+		if err := tw.Auth(); err != nil {
+			fmt.Fprintln(os.Stderr, "could not refresh the token:", err)
+			return exitFailed
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		flag.Usage()
+		return exitUsage
+	}
+	return exitOK
+}
+
+func authorize(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("authorize", flag.ContinueOnError)
+	redirect := fs.String("redirect", "http://localhost:3000/", `redirect url registered for the twitch application, it is listened on`)
+	device := fs.Bool("device", false, `use the device code flow, for hosts without a browser`)
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	m := twitchauth.New(config.HolderFromContext(ctx))
+	var err error
+	if *device {
+		err = m.AuthorizeDevice(os.Stdout)
+	} else {
+		err = m.Authorize(*redirect, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "authorization failed:", err)
+		return exitFailed
+	}
+	fmt.Println("Authorized, the tokens were saved")
+	return exitOK
+}
+
+func deadLetters(ctx context.Context, args []string) int {
+	err := dlq.Command(dlq.FromContext(ctx), args[1:], os.Stdout, api.FromContext(ctx).SendToApi)
+	switch {
+	case errors.Is(err, dlq.ErrUsage):
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// watchReload reloads the config on SIGHUP, an invalid config is logged and
+// the old one kept, it never returns
+func watchReload(ctx context.Context, apis []*api.Api) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		cfg, err := config.Reload(ctx, config.AppTwitchScrape)
+		if err != nil {
+			d.P("Could not reload the config, keeping the old one: ", err)
+			continue
+		}
+		d.SetDebugging(cfg.Debug.Debug)
+		for _, a := range apis {
+			a.Reloaded()
+		}
+		d.P("Reloaded the config")
+	}
+}
+
+func writeSubs(users []twitch.User, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"id", "name", "tier", "is_gift", "gifter_id", "gifter_login", "plan_name"})
+		for _, u := range users {
+			w.Write([]string{u.ID, u.Name, strconv.Itoa(u.Tier), strconv.FormatBool(u.IsGift), u.GifterID, u.GifterName, u.PlanName})
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
@@ -0,0 +1,214 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package snapshot persists the last known state of the subs between restarts
+// so that the diff sent to the website stays minimal
+package snapshot
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/atomicfile"
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	defaultFile = "twitchsubs.json"
+	redisKey    = "twitchscrape:subs"
+	tableName   = "twitchscrape_snapshot"
+)
+
+// Store loads and saves the subs keyed by id, the value is the tier of the sub
+// or 0 if it expired
+type Store interface {
+	Load() (map[string]int, error)
+	Save(subs map[string]int) error
+}
+
+// New returns the store selected by TwitchScrape.SnapshotStore, the file
+// store is the default
+// channel is the name of the channel block cfg belongs to, every channel gets
+// a store of its own, empty without channel blocks
+func New(cfg *config.AppConfig, channel string) (Store, error) {
+	switch cfg.TwitchScrape.SnapshotStore {
+	case "", "file":
+		path := cfg.TwitchScrape.SnapshotFile
+		if path == "" {
+			path = defaultFile
+			if channel != "" {
+				path = config.ChannelPath(path, channel)
+			}
+		}
+		return &FileStore{path: path}, nil
+	case "database":
+		table := tableName
+		if channel != "" {
+			table += "_" + channel
+		}
+		return NewDatabaseStore(&cfg.Database, table)
+	case "redis":
+		key := redisKey
+		if channel != "" {
+			key += ":" + channel
+		}
+		return NewRedisStore(&cfg.Redis, key), nil
+	default:
+		return nil, fmt.Errorf("unknown snapshot store %q", cfg.TwitchScrape.SnapshotStore)
+	}
+}
+
+type FileStore struct {
+	path string
+}
+
+func (s *FileStore) Load() (map[string]int, error) {
+	subs := map[string]int{}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return subs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// Save replaces the snapshot atomically
+func (s *FileStore) Save(subs map[string]int) error {
+	data, err := json.Marshal(subs)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(s.path, data, 0600)
+}
+
+type DatabaseStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewDatabaseStore(cfg *config.Database, table string) (*DatabaseStore, error) {
+	db, err := sql.Open("mysql", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(cfg.MaxIdleConnections)
+	db.SetMaxOpenConns(cfg.MaxConnections)
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ` + table + ` (
+			authid VARCHAR(100) NOT NULL PRIMARY KEY,
+			tier   TINYINT NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DatabaseStore{db: db, table: table}, nil
+}
+
+func (s *DatabaseStore) Load() (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT authid, tier FROM ` + s.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := map[string]int{}
+	for rows.Next() {
+		var id string
+		var tier int
+		if err := rows.Scan(&id, &tier); err != nil {
+			return nil, err
+		}
+		subs[id] = tier
+	}
+	return subs, rows.Err()
+}
+
+// Save replaces the whole snapshot in a single transaction
+func (s *DatabaseStore) Save(subs map[string]int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM ` + s.table); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO ` + s.table + ` (authid, tier) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for id, tier := range subs {
+		if _, err := stmt.Exec(id, tier); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type RedisStore struct {
+	pool *redis.Pool
+	key  string
+}
+
+func NewRedisStore(cfg *config.Redis, key string) *RedisStore {
+	return &RedisStore{key: key, pool: &redis.Pool{
+		MaxIdle:   cfg.PoolSize,
+		MaxActive: cfg.PoolSize,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", cfg.Addr,
+				redis.DialPassword(cfg.Password),
+				redis.DialDatabase(cfg.DBIndex),
+			)
+		},
+	}}
+}
+
+func (s *RedisStore) Load() (map[string]int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.IntMap(conn.Do("HGETALL", s.key))
+}
+
+// Save replaces the whole hash in a single MULTI/EXEC block
+func (s *RedisStore) Save(subs map[string]int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", s.key)
+	if len(subs) > 0 {
+		args := redis.Args{}.Add(s.key).AddFlat(subs)
+		conn.Send("HSET", args...)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
@@ -0,0 +1,117 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+)
+
+// the kinds of errors the helix client returns, match them with errors.Is
+var (
+	ErrAuthExpired      = errors.New("access token expired")
+	ErrRefreshRevoked   = errors.New("refresh token revoked")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrServer           = errors.New("twitch server error")
+	ErrUnexpectedStatus = errors.New("unexpected status code")
+	ErrDecode           = errors.New("could not decode response")
+	ErrNetwork          = errors.New("network error")
+)
+
+// Error wraps the underlying cause of a failed twitch call together with its
+// kind, Reset is only set for rate limited calls
+type Error struct {
+	Kind       error
+	StatusCode int
+	Reset      time.Time
+	Err        error
+}
+
+func (e *Error) Error() string {
+	s := "twitch: " + e.Kind.Error()
+	if e.StatusCode != 0 {
+		s += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// statusError classifies a non-200 helix response
+func statusError(res *http.Response, body []byte) *Error {
+	e := &Error{
+		StatusCode: res.StatusCode,
+		Err:        fmt.Errorf("%s", body),
+	}
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		e.Kind = ErrAuthExpired
+	case res.StatusCode == http.StatusTooManyRequests:
+		e.Kind = ErrRateLimited
+		e.Reset = resetTime(res.Header)
+	case res.StatusCode >= 500:
+		e.Kind = ErrServer
+	default:
+		e.Kind = ErrUnexpectedStatus
+	}
+	return e
+}
+
+// authError classifies an error of the token manager
+func authError(err error) error {
+	e := &Error{Err: err}
+	var serr *twitchauth.StatusError
+	switch {
+	case errors.Is(err, twitchauth.ErrRefreshRevoked):
+		e.Kind = ErrRefreshRevoked
+	case errors.Is(err, twitchauth.ErrDecode):
+		e.Kind = ErrDecode
+	case errors.As(err, &serr):
+		e.StatusCode = serr.StatusCode
+		e.Kind = ErrUnexpectedStatus
+		if serr.StatusCode >= 500 {
+			e.Kind = ErrServer
+		}
+	default:
+		e.Kind = ErrNetwork
+	}
+	return e
+}
+
+// resetTime parses the Ratelimit-Reset header, a unix timestamp
+func resetTime(h http.Header) time.Time {
+	sec, err := strconv.ParseInt(h.Get("Ratelimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
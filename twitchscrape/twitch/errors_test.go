@@ -0,0 +1,89 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package twitch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetSubsAuthExpired(t *testing.T) {
+	var refreshed bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/helix/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer renewed" {
+			http.Error(w, `{"status":401}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(page(1, "", "1")))
+	})
+	mux.HandleFunc("/auth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		refreshed = true
+		w.Write([]byte(`{"access_token":"renewed","refresh_token":"refresh2","expires_in":3600}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tw := newTestTwitch(t, srv, 0)
+	_, err := tw.GetSubs()
+	var terr *Error
+	if !errors.Is(err, ErrAuthExpired) || !errors.As(err, &terr) || terr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("err = %v, want ErrAuthExpired", err)
+	}
+	if !refreshed || tw.auth.Token() != "renewed" {
+		t.Fatalf("token = %q, want it renewed", tw.auth.Token())
+	}
+
+	// the retry of the caller goes through with the renewed token
+	if _, err := tw.GetSubs(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSubsStatusErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		kind   error
+	}{
+		{http.StatusInternalServerError, ErrServer},
+		{http.StatusBadGateway, ErrServer},
+		{http.StatusServiceUnavailable, ErrServer},
+		{http.StatusBadRequest, ErrUnexpectedStatus},
+		{http.StatusNotFound, ErrUnexpectedStatus},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "nope", tt.status)
+			}))
+			defer srv.Close()
+
+			_, err := newTestTwitch(t, srv, 0).GetSubs()
+			var terr *Error
+			if !errors.Is(err, tt.kind) || !errors.As(err, &terr) || terr.StatusCode != tt.status {
+				t.Fatalf("err = %v, want %v", err, tt.kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package twitch
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+)
+
+const (
+	// how many times a 429 response is retried before giving up
+	maxRateLimitRetries = 3
+	// used when twitch does not tell us when the bucket refills
+	defaultRateLimitWait = 10 * time.Second
+)
+
+// limiter is a token bucket driven by the helix rate limit headers
+// https://dev.twitch.tv/docs/api/guide#twitch-rate-limits
+type limiter struct {
+	mu sync.Mutex
+	// remaining is the number of tokens left in the bucket, -1 until the
+	// first response tells us
+	remaining int
+	limit     int
+	// reset is when the bucket is refilled
+	reset time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{remaining: -1}
+}
+
+// Wait blocks until the bucket has a token and takes it
+func (l *limiter) Wait() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.remaining == 0 {
+		if dur := time.Until(l.reset); dur > 0 {
+			d.DF(1, "helix rate limit exhausted, waiting %s", dur)
+			time.Sleep(dur)
+		}
+		l.remaining = l.limit
+	}
+	if l.remaining > 0 {
+		l.remaining--
+	}
+}
+
+// Update records the budget the response headers advertise
+func (l *limiter) Update(h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("Ratelimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remaining = remaining
+	if limit, err := strconv.Atoi(h.Get("Ratelimit-Limit")); err == nil {
+		l.limit = limit
+	}
+	l.reset = resetTime(h)
+}
+
+// Exhausted empties the bucket until reset, used on 429 responses
+func (l *limiter) Exhausted(reset time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if reset.IsZero() {
+		reset = time.Now().Add(defaultRateLimitWait)
+	}
+	l.remaining = 0
+	l.reset = reset
+}
+
+// helixDo sends a request to helix respecting the shared rate limit, 429
+// responses are retried after the advertised reset
+// the request must not have a body, so that it can be resent
+func (t *Twitch) helixDo(req *http.Request) (*http.Response, error) {
+	for tries := 0; ; tries++ {
+		t.limiter.Wait()
+		res, err := t.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		t.limiter.Update(res.Header)
+
+		if res.StatusCode != http.StatusTooManyRequests || tries >= maxRateLimitRetries {
+			return res, nil
+		}
+
+		d.DF(1, "rate limited by helix, reset at %s", res.Header.Get("Ratelimit-Reset"))
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		t.limiter.Exhausted(resetTime(res.Header))
+	}
+}
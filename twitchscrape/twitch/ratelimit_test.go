@@ -0,0 +1,86 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package twitch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHelixRateLimitRetry(t *testing.T) {
+	reset := time.Unix(time.Now().Unix()+1, 0)
+	var mu sync.Mutex
+	var calls []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, time.Now())
+		n := len(calls)
+		mu.Unlock()
+		if n == 1 {
+			w.Header().Set("Ratelimit-Limit", "800")
+			w.Header().Set("Ratelimit-Remaining", "0")
+			w.Header().Set("Ratelimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(page(1, "", "1")))
+	}))
+	defer srv.Close()
+
+	users, err := newTestTwitch(t, srv, 0).GetSubs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("users = %+v", users)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 2 {
+		t.Fatalf("%d calls, want the 429 retried once", len(calls))
+	}
+	if calls[1].Before(reset) {
+		t.Fatalf("retried at %s, before the reset at %s", calls[1], reset)
+	}
+}
+
+func TestHelixRateLimitGivesUp(t *testing.T) {
+	// a reset in the past keeps the test from sleeping between the retries
+	reset := time.Now().Add(-time.Minute).Unix()
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Ratelimit-Reset", strconv.FormatInt(reset, 10))
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	_, err := newTestTwitch(t, srv, 0).GetSubs()
+	var terr *Error
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &terr) || terr.Reset.Unix() != reset {
+		t.Fatalf("err = %v, want ErrRateLimited with the reset", err)
+	}
+	if calls != maxRateLimitRetries+1 {
+		t.Fatalf("%d calls, want %d", calls, maxRateLimitRetries+1)
+	}
+}
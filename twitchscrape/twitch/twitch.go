@@ -21,7 +21,6 @@ package twitch
 
 import (
 	_ "crypto/sha512"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -31,40 +30,64 @@ import (
 
 	"github.com/destinygg/twitch-subscriber-sync/internal/config"
 	"github.com/destinygg/twitch-subscriber-sync/internal/debug"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
 	"golang.org/x/net/context"
 	"strconv"
 )
 
 type Twitch struct {
-	cfg         *config.TwitchScrape
+	cfg         *config.Holder
 	apibase     string
-	authapibase string
+	auth        *twitchauth.Manager
+	client      *http.Client
+	// limiter is shared by every helix call
+	limiter *limiter
 }
 
 type User struct {
-	ID      string
-	Name    string
+	ID         string
+	Name       string
+	Tier       int // 1, 2 or 3, derived from the helix 1000/2000/3000 values
+	IsGift     bool
+	GifterID   string
+	GifterName string
+	PlanName   string
 }
 
-type TokenStruct struct {
-	AccessToken string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	Scope []string `json:"scope"`
+// IncompleteError is returned by GetSubs when the paginated result does not
+// add up, the list is partial and must not be synced
+type IncompleteError struct {
+	Collected int
+	Total     int
+	Reason    string
 }
 
-var client = &http.Client{
-	Timeout: 30 * time.Second,
-	Transport: &http.Transport{
-		TLSClientConfig:       &tls.Config{},
-		ResponseHeaderTimeout: 30 * time.Second,
-	},
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("incomplete list of subs (%s), collected %d of %d", e.Reason, e.Collected, e.Total)
 }
 
+// used when TotalTolerance is not configured
+const defaultTotalTolerance = 5
+
+// Init creates the helix client, the tls settings are read once here
 func Init(ctx context.Context) context.Context {
+	h := config.HolderFromContext(ctx)
+	tlsConfig, err := h.Get().TwitchScrape.TLS.Config()
+	if err != nil {
+		d.F("invalid twitchscrape.tls: %v", err)
+	}
 	tw := &Twitch{
-		cfg:     &config.FromContext(ctx).TwitchScrape,
+		cfg:     h,
 		apibase: "https://api.twitch.tv/helix/",
-		authapibase: "https://id.twitch.tv/oauth2/",
+		auth:    twitchauth.FromContext(ctx),
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:       tlsConfig,
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		},
+		limiter: newLimiter(),
 	}
 	return context.WithValue(ctx, "twitch", tw)
 }
@@ -79,8 +102,13 @@ func (t *Twitch) GetSubs() ([]User, error) {
 	var users []User
 	var js struct {
 		Subs []struct {
-			Name string `json:"user_login"`
-			ID   string `json:"user_id"`
+			Name       string `json:"user_login"`
+			ID         string `json:"user_id"`
+			Tier       string `json:"tier"`
+			IsGift     bool   `json:"is_gift"`
+			GifterID   string `json:"gifter_id"`
+			GifterName string `json:"gifter_login"`
+			PlanName   string `json:"plan_name"`
 		} `json:"data"`
 
 		Pagination struct {
@@ -93,122 +121,148 @@ func (t *Twitch) GetSubs() ([]User, error) {
 	cursor := ""
 	limit := 100
 	urlBase := t.apibase + "subscriptions"
+	total := 0
+	// used to detect cursors repeating and subs shifting between pages
+	seenCursors := map[string]struct{}{}
+	seenIDs := map[string]struct{}{}
 
+	// a reload while paginating must not switch channels halfway through
+	cfg := &t.cfg.Get().TwitchScrape
+	token := t.auth.Token()
 	headers := http.Header{
-		"Authorization": []string{"Bearer " + t.cfg.AccessToken},
-		"Client-ID":     []string{t.cfg.ClientID},
+		"Authorization": []string{"Bearer " + token},
+		"Client-ID":     []string{cfg.ClientID},
 	}
 
 	for {
-		urlStr := urlBase + "?broadcaster_id=" + t.cfg.ChannelID + "&first=" + strconv.Itoa(limit) + "&after=" + cursor
-
-		var err error
-		var res *http.Response
-		{
-			u, err := url.Parse(urlStr)
-			if err != nil {
-				d.P("could not parse url", urlStr)
-				return nil, err
-			}
-			d.DF(1,"Calling %s", u)
-			res, err = client.Do(&http.Request{
-				Method:     "GET",
-				URL:        u,
-				Proto:      "HTTP/1.1",
-				ProtoMajor: 1,
-				ProtoMinor: 1,
-				Header:     headers,
-				Body:       nil,
-				Host:       u.Host,
-			})
+		urlStr := urlBase + "?broadcaster_id=" + cfg.ChannelID + "&first=" + strconv.Itoa(limit) + "&after=" + cursor
+
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			d.P("could not parse url", urlStr)
+			return nil, err
+		}
+		d.DF(1, "Calling %s", u)
+		res, err := t.helixDo(&http.Request{
+			Method:     "GET",
+			URL:        u,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     headers,
+			Body:       nil,
+			Host:       u.Host,
+		})
+		if err != nil {
+			d.P("Failed to GET the subscribers, url, err", urlStr, err)
+			return nil, &Error{Kind: ErrNetwork, Err: err}
 		}
 
 		bodyBytes, err := ioutil.ReadAll(res.Body)
-		if err == nil {
-			d.DF(1, "%s - %s", res.Status, bodyBytes)
+		res.Body.Close()
+		if err != nil {
+			return nil, &Error{Kind: ErrNetwork, StatusCode: res.StatusCode, Err: err}
 		}
+		d.DF(1, "%s - %s", res.Status, bodyBytes)
 
-		if res != nil && res.StatusCode == 401 {
-			t.Auth()
-			return nil, fmt.Errorf("bad auth response")
-		}
-		if err != nil || res == nil || res.StatusCode != 200 {
-			if err == nil {
-				err = fmt.Errorf("non-200 statuscode received from twitch")
+		if res.StatusCode != 200 {
+			err := statusError(res, bodyBytes)
+			d.P("Failed to GET the subscribers, url, err", urlStr, err)
+			// refresh the token so that the retry can succeed, if that fails
+			// too the reason is more interesting to the caller
+			if err.Kind == ErrAuthExpired {
+				if aerr := t.auth.Renew(token); aerr != nil {
+					return nil, authError(aerr)
+				}
 			}
-			d.P("Failed to GET the subscribers, url, res, err", urlStr, res, err)
 			return nil, err
 		}
 
+		js.Subs = nil
+		js.Pagination.Cursor = ""
 		err = json.Unmarshal(bodyBytes, &js)
-		res.Body.Close()
 		if err != nil {
 			d.P("Failed to decode json, err", err)
-			return nil, err
+			return nil, &Error{Kind: ErrDecode, StatusCode: res.StatusCode, Err: err}
 		}
 		if users == nil {
 			users = make([]User, 0, js.Total)
 		}
+		total = js.Total
 		d.DF(1, "Successful response. Returned records [%v] Total users [%v]", len(js.Subs), len(users))
 
 		for _, u := range js.Subs {
+			if _, ok := seenIDs[u.ID]; ok {
+				continue
+			}
+			seenIDs[u.ID] = struct{}{}
 			users = append(users, User{
-				ID:      fmt.Sprintf("%v", u.ID),
-				Name:    u.Name,
+				ID:         fmt.Sprintf("%v", u.ID),
+				Name:       u.Name,
+				Tier:       parseTier(u.Tier),
+				IsGift:     u.IsGift,
+				GifterID:   u.GifterID,
+				GifterName: u.GifterName,
+				PlanName:   u.PlanName,
 			})
 		}
 
 		cursor = js.Pagination.Cursor
 
-		// Finished when no subs are returned, which indicates the last page.
-		if len(js.Subs) == 0 {
+		// Finished when no subs or no cursor is returned, which indicates the
+		// last page.
+		if len(js.Subs) == 0 || cursor == "" {
+			if err := t.checkTotal(len(users), total); err != nil {
+				d.P("Incomplete list of subs", err)
+				return nil, err
+			}
 			return users, nil
 		}
+
+		if _, ok := seenCursors[cursor]; ok {
+			err := &IncompleteError{Collected: len(users), Total: total, Reason: "cursor repeated"}
+			d.P("Incomplete list of subs", err)
+			return nil, err
+		}
+		seenCursors[cursor] = struct{}{}
+	}
+}
+
+// checkTotal compares the number of collected subs to the total twitch
+// reported, subs can come and go while paginating so some slack is allowed
+func (t *Twitch) checkTotal(collected, total int) error {
+	tolerance := t.cfg.Get().TwitchScrape.TotalTolerance
+	if tolerance == 0 {
+		tolerance = defaultTotalTolerance
+	}
+	if tolerance < 0 {
+		return nil
+	}
+
+	diff := collected - total
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		return &IncompleteError{Collected: collected, Total: total, Reason: "total mismatch"}
+	}
+	return nil
+}
+
+// parseTier converts the helix tier string ("1000", "2000", "3000") into
+// 1, 2 or 3, anything unparseable is treated as a tier 1 sub
+func parseTier(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1000 {
+		return 1
 	}
+	return n / 1000
 }
 
+// Auth refreshes the access token
 func (t *Twitch) Auth() error {
-	d.DF(1, "renewing access token")
-	u, _ := url.Parse(t.authapibase + "token")
-	q := u.Query()
-	q.Add("grant_type", "refresh_token")
-	q.Add("refresh_token", t.cfg.RefreshToken)
-	q.Add("client_id", t.cfg.ClientID)
-	q.Add("client_secret", t.cfg.ClientSecret)
-	u.RawQuery = q.Encode()
-	var res *http.Response
-	{
-		d.DF(1, "Calling %s", u)
-		res, err := client.Do(&http.Request{
-			Method:     "POST",
-			URL:        u,
-			Proto:      "HTTP/1.1",
-			ProtoMinor: 1,
-			Header:     nil,
-			Body:       nil,
-			Host:       u.Host,
-		})
-		if err != nil || res == nil || res.StatusCode != 200 {
-			if res != nil && res.StatusCode != 200 {
-				err = fmt.Errorf("non-200 statuscode received from twitch %v", res)
-			} else if err == nil {
-				err = fmt.Errorf("non-200 statuscode received from twitch")
-			}
-			d.P("Failed to GET the auth token, url, res, err", u, res, err)
-			return err
-		}
-		tokens := &TokenStruct{}
-		err = json.NewDecoder(res.Body).Decode(tokens)
-		res.Body.Close()
-		if err != nil {
-			d.P("Failed to decode twitch response %v", err)
-			return err
-		}
-		d.DF(1, "Updated OAuth Tokens")
-		t.cfg.RefreshToken = tokens.RefreshToken
-		t.cfg.AccessToken = tokens.AccessToken
-		config.ReadTokensFile(t.cfg, true)
+	if err := t.auth.Refresh(); err != nil {
+		return authError(err)
 	}
-	d.DF(1, "Response %s", res)
 	return nil
 }
@@ -0,0 +1,141 @@
+/***
+  This file is part of twitchscrape.
+
+  twitchscrape is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  twitchscrape is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with twitchscrape; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/destinygg/twitch-subscriber-sync/internal/config"
+	"github.com/destinygg/twitch-subscriber-sync/internal/twitchauth"
+)
+
+// newTestTwitch returns a client talking to helix and the auth api under
+// /helix/ and /auth/ of srv
+func newTestTwitch(t *testing.T, srv *httptest.Server, tolerance int) *Twitch {
+	cfg := &config.AppConfig{}
+	cfg.TwitchScrape.ClientID = "client"
+	cfg.TwitchScrape.ChannelID = "1"
+	cfg.TwitchScrape.AccessToken = "token"
+	cfg.TwitchScrape.RefreshToken = "refresh"
+	cfg.TwitchScrape.AuthURL = srv.URL + "/auth/"
+	cfg.TwitchScrape.TokensFile = filepath.Join(t.TempDir(), "twitchtokens")
+	cfg.TwitchScrape.TotalTolerance = tolerance
+	h := &config.Holder{}
+	h.Set(cfg)
+	return &Twitch{
+		cfg:     h,
+		apibase: srv.URL + "/helix/",
+		auth:    twitchauth.New(h),
+		client:  srv.Client(),
+		limiter: newLimiter(),
+	}
+}
+
+// page returns a helix subscriptions response with the given user ids
+func page(total int, cursor string, ids ...string) string {
+	var subs []string
+	for _, id := range ids {
+		subs = append(subs, fmt.Sprintf(`{"user_id":"%s","user_login":"user%s","tier":"1000"}`, id, id))
+	}
+	return fmt.Sprintf(`{"data":[%s],"pagination":{"cursor":"%s"},"total":%d}`, strings.Join(subs, ","), cursor, total)
+}
+
+// pages serves the response of the after parameter of every request
+func pages(responses map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, ok := responses[r.URL.Query().Get("after")]
+		if !ok {
+			http.Error(w, "unknown cursor", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(res))
+	}
+}
+
+func TestGetSubsPages(t *testing.T) {
+	srv := httptest.NewServer(pages(map[string]string{
+		"":  page(3, "a", "1", "2"),
+		"a": page(3, "", "3"),
+	}))
+	defer srv.Close()
+
+	users, err := newTestTwitch(t, srv, 0).GetSubs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[2].ID != "3" || users[2].Tier != 1 {
+		t.Fatalf("users = %+v", users)
+	}
+}
+
+func TestGetSubsRepeatedCursor(t *testing.T) {
+	srv := httptest.NewServer(pages(map[string]string{
+		"":  page(4, "a", "1"),
+		"a": page(4, "b", "2"),
+		"b": page(4, "a", "3"),
+	}))
+	defer srv.Close()
+
+	_, err := newTestTwitch(t, srv, 0).GetSubs()
+	var ierr *IncompleteError
+	if !errors.As(err, &ierr) || ierr.Reason != "cursor repeated" {
+		t.Fatalf("err = %v, want a repeated cursor", err)
+	}
+}
+
+func TestGetSubsTotalMismatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		total     int
+		tolerance int
+		wantErr   bool
+	}{
+		{"exact", 2, 0, false},
+		{"within the default tolerance", 2 + defaultTotalTolerance, 0, false},
+		{"outside the default tolerance", 3 + defaultTotalTolerance, 0, true},
+		{"outside the tolerance", 4, 1, true},
+		{"tolerance disabled", 100, -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(pages(map[string]string{
+				"": page(tt.total, "", "1", "2"),
+			}))
+			defer srv.Close()
+
+			users, err := newTestTwitch(t, srv, tt.tolerance).GetSubs()
+			var ierr *IncompleteError
+			if tt.wantErr {
+				if !errors.As(err, &ierr) || ierr.Reason != "total mismatch" || ierr.Collected != 2 || ierr.Total != tt.total {
+					t.Fatalf("err = %v, want a total mismatch", err)
+				}
+				if users != nil {
+					t.Fatalf("returned a partial list of %d subs", len(users))
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}